@@ -1,43 +1,75 @@
 package bot
 
 import (
+	"fmt"
 	"log"
 	"net"
 	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/thoj/go-ircevent"
 	"github.com/zenithar/aktarus/config"
 	"github.com/zenithar/aktarus/debug"
+	"github.com/zenithar/aktarus/permissions"
 	"github.com/zenithar/aktarus/plugins"
+	"github.com/zenithar/aktarus/queue"
 	"github.com/zenithar/aktarus/state"
 )
 
 type Bot struct {
 	conn    *irc.Connection
+	queue   *queue.Queue
 	cfg     *config.Settings
 	pm      *plugins.PluginManager
+	network *plugins.Network
 	state   *state.StateTracker
+	perms   *permissions.Manager
 	Quitted chan bool
+
+	// Capability negotiation for the current connection
+	capNegotiating bool
+	capsAvailable  map[string]string
+	capsRequested  int
+
+	// Progress of SASL authentication for the current connection, only
+	// accessed atomically
+	saslStatus int32
+
+	// Reconnect tracking, only accessed atomically
+	quitting, reconnecting, failures int32
 }
 
 func (bot *Bot) Quit() {
+	atomic.StoreInt32(&bot.quitting, 1)
 	bot.conn.Quit()
 	bot.Quitted <- true
 }
 
 func (bot *Bot) Connect() error {
 	bot.InitCallbacks()
+
 	// Connect
+	server := bot.cfg.Irc.Host
 	if bot.cfg.Irc.Port != "" {
-		return bot.conn.Connect(net.JoinHostPort(bot.cfg.Irc.Host, bot.cfg.Irc.Port))
+		server = net.JoinHostPort(bot.cfg.Irc.Host, bot.cfg.Irc.Port)
 	}
-	return bot.conn.Connect(bot.cfg.Irc.Host)
+	if err := bot.conn.Connect(server); err != nil {
+		return err
+	}
+
+	// Negotiate capabilities and authenticate before registering
+	bot.StartCapNegotiation()
+
+	// Reconnect whenever the connection drops
+	go bot.watchConnection()
+	return nil
 }
 
 func (bot *Bot) InitCallbacks() error {
 	// Drop nick handling standardd callbacks (we will be using our own)
 	bot.conn.ClearCallback("433")
+	bot.conn.ClearCallback("437")
 
 	// Setup state tracker
 	bot.state.InitStateCallbacks()
@@ -45,9 +77,18 @@ func (bot *Bot) InitCallbacks() error {
 	// Handle built-in commands
 	bot.conn.AddCallback("PRIVMSG", bot.RunBuiltinCommands)
 
+	// Handle capability negotiation and SASL authentication
+	bot.conn.AddCallback("CAP", bot.HandleCap)
+	bot.conn.AddCallback("AUTHENTICATE", bot.SaslAuthenticate)
+	for _, code := range []string{"902", "903", "904", "905", "906"} {
+		bot.conn.AddCallback(code, bot.SaslResult)
+	}
+
 	// Handle built-in callbacks
 	bot.conn.AddCallback("433", bot.ReclaimNick)   // Reclaim stolen nicks
+	bot.conn.AddCallback("437", bot.ReclaimNick)   // Reclaim stolen nicks
 	bot.conn.AddCallback("JOIN", bot.AutoVoice)    // Autovoice people
+	bot.conn.AddCallback("001", bot.Registered)    // Track reconnects
 	bot.conn.AddCallback("001", bot.SetBotState)   // Setup bot state
 	bot.conn.AddCallback("477", bot.JoinChannels)  // Try to re-join channels
 	bot.conn.AddCallback("001", bot.JoinChannels)  // Try to join channels on connect
@@ -56,14 +97,27 @@ func (bot *Bot) InitCallbacks() error {
 	bot.conn.AddCallback("PONG", bot.JoinChannels) // Periodically try and rejoin if not already joined
 
 	// Setup plugin callbacks
-	bot.pm.InitPluginCallbacks()
+	bot.pm.InitPluginCallbacks(bot.network)
 
 	return nil
 }
 
-func New(cfg *config.Settings) (*Bot, error) {
-	// Set up Irc Client
-	client := irc.IRC(cfg.Irc.Nick, cfg.Irc.Username)
+// Returns a bot connecting to the network cfg describes, sharing the
+// plugins of pm
+func New(cfg *config.Settings, pm *plugins.PluginManager) (*Bot, error) {
+	// Check SASL can work before connecting at all
+	if cfg.Irc.Sasl {
+		if _, err := saslResponse(cfg.Irc.SaslMech, cfg.Irc.SaslLogin, cfg.Irc.SaslPass); err != nil {
+			return nil, err
+		}
+		if cfg.Irc.SaslMech == "EXTERNAL" && (!cfg.Irc.Ssl || cfg.Irc.SslCert == "") {
+			return nil, fmt.Errorf("SASL EXTERNAL needs Ssl and a client certificate in SslCert")
+		}
+	}
+
+	// Set up Irc Client, the real nick being sent once capability
+	// negotiation started
+	client := irc.IRC(unregisteredNick, cfg.Irc.Username)
 
 	if cfg.Irc.Version != "" {
 		client.Version = cfg.Irc.Version
@@ -91,27 +145,43 @@ func New(cfg *config.Settings) (*Bot, error) {
 	// Optionally, enable SSL
 	client.UseTLS = cfg.Irc.Ssl
 
+	// Present a client certificate, for SASL EXTERNAL or networks
+	// recognising its fingerprint
+	if cfg.Irc.SslCert != "" {
+		tlsConfig, err := loadClientCert(cfg.Irc.SslCert, cfg.Irc.SslKey)
+		if err != nil {
+			return nil, err
+		}
+		client.TLSConfig = tlsConfig
+	}
+
 	// Setup IRC logger
-	client.Log = log.New(os.Stdout, "[irc] ", log.LstdFlags)
+	client.Log = log.New(os.Stdout, "[irc:"+cfg.Name+"] ", log.LstdFlags)
 
 	// Make bot instance
 	bot := &Bot{
 		cfg:     cfg,
 		conn:    client,
+		pm:      pm,
 		Quitted: make(chan bool, 1),
 	}
 
+	// Throttle everything we send
+	bot.queue = queue.New(client, cfg.Irc.FloodBurst, cfg.Irc.FloodRate)
+
 	// Setup state tracker
-	bot.state = state.New(cfg, client)
+	bot.state = state.New(cfg, client, bot.queue)
+	bot.queue.SetSource(bot.state.Source)
 
-	// Give debug a window into the state handler
-	debug.SetState(bot.state)
+	// Give debug a window into the state handler and send queue
+	debug.SetState(cfg.Name, bot.state)
+	debug.SetQueue(cfg.Name, bot.queue)
 
-	// Setup plugin manager
-	bot.pm = plugins.New(cfg, client, bot.state)
+	// Setup permissions, based on the tracked state
+	bot.perms = permissions.New(cfg, bot.state)
 
-	// Boot up the plugin js environment
-	bot.pm.InitJS()
+	// Make the plugins available on this network
+	bot.network = pm.AddNetwork(cfg, client, bot.queue, bot.state, bot.perms)
 
 	return bot, nil
 }
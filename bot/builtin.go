@@ -3,7 +3,9 @@ package bot
 import (
 	"fmt"
 	"github.com/thoj/go-ircevent"
+	"github.com/zenithar/aktarus/config"
 	"github.com/zenithar/aktarus/debug"
+	"github.com/zenithar/aktarus/state"
 	"github.com/zenithar/aktarus/utils"
 	"sort"
 	"strings"
@@ -11,107 +13,183 @@ import (
 )
 
 func (bot *Bot) RunBuiltinCommands(event *irc.Event) {
-	args := strings.Split(strings.TrimSpace(event.Message()), " ")
-	command := args[0]
-
-	// Bin the command from the arg list
-	if len(args) > 1 {
-		args = args[1:]
-	} else {
-		args = []string{}
+	cmd, ok := bot.state.ParseCommand(event)
+	if !ok {
+		return
 	}
+	command, args := cmd.Name, cmd.Args
+	prefix := bot.state.ReplyPrefix(cmd, event.Arguments[0])
 
-	// Get the current channel privileges for the nick sending this command
-	privs, ok := bot.state.GetPrivs(event.Arguments[0], event.Nick)
+	// Replies to private messages go to the sender
+	reply := event.Arguments[0]
+	if !bot.state.ServerInfo().IsChannel(reply) {
+		reply = event.Nick
+	}
 
-	// Commands must be run by known users
+	// Privileged commands check their permission last, so nobody gets
+	// told off for commands that wouldn't have run anyway
 	switch {
-	case command == "!rejoin" && event.Arguments[0] == bot.conn.GetNick():
-		bot.conn.Join(bot.cfg.Irc.NormalChannel)
-		bot.conn.Join(bot.cfg.Irc.StaffChannel)
-	case ok && command == "!reload":
-		if privs.Owner || privs.Admin || privs.Op {
-			bot.pm.InitJS()
-			utils.IRCAction(bot.conn, event.Arguments[0], "has reloaded its plugins")
-		} else {
-			utils.IRCAction(bot.conn, event.Arguments[0], fmt.Sprintf("slaps %s's hands away from the op only controls", event.Nick))
+	case command == "rejoin" && bot.state.EqualFold(event.Arguments[0], bot.conn.GetNick()):
+		for _, channel := range bot.cfg.Channel {
+			bot.queue.Join(channel.Name, channel.Key)
 		}
-	case command == "!ping":
-		bot.conn.Privmsg(event.Arguments[0], fmt.Sprintf("%s: PONG!", event.Nick))
-	case ok && command == "!quit":
-		if privs.Owner || privs.Admin || privs.Op {
-			bot.Quit()
+	case command == "reload" && bot.permitted(event, "reload"):
+		bot.pm.InitJS()
+		utils.IRCAction(bot.queue, event.Arguments[0], "has reloaded its plugins")
+	case command == "ping":
+		bot.queue.Privmsg(reply, fmt.Sprintf("%s: PONG!", event.Nick))
+	case command == "quit" && bot.permitted(event, "quit"):
+		bot.Quit()
+	case command == "voice" && bot.permitted(event, "voice"):
+		bot.VoiceAll(event)
+	case (command == "op" || command == "deop") && len(args) > 0 && bot.permitted(event, "op"):
+		bot.OpNicks(event.Arguments[0], command == "op", args)
+	case (command == "ban" || command == "unban") && len(args) > 0 && bot.permitted(event, "ban"):
+		bot.BanMasks(event.Arguments[0], command == "ban", args)
+	case command == "help":
+		if len(args) == 0 {
+			bot.ShowCommandList(reply, event.Nick, prefix)
 		} else {
-			utils.IRCAction(bot.conn, event.Arguments[0], fmt.Sprintf("slaps %s's hands away from the op only controls", event.Nick))
+			bot.ShowCommandHelp(reply, event.Nick, prefix, strings.TrimPrefix(args[0], prefix))
 		}
-	case ok && command == "!voice":
-		if privs.Owner || privs.Admin || privs.Op {
-			bot.VoiceAll(event)
-		} else {
-			utils.IRCAction(bot.conn, event.Arguments[0], fmt.Sprintf("slaps %s's hands away from the op only controls", event.Nick))
+	case command == "import" && len(args) >= 2 && bot.isStaffChannel(event.Arguments[0]) && bot.permitted(event, "import"):
+		overwrite, checksum := false, ""
+		for _, arg := range args[2:] {
+			switch {
+			case arg == "overwrite":
+				overwrite = true
+			case strings.HasPrefix(arg, "sha256:"):
+				checksum = strings.TrimPrefix(arg, "sha256:")
+			}
 		}
-	case command == "!help":
-		if len(args) == 0 {
-			bot.ShowCommandList(event.Arguments[0], event.Nick)
+		if manifest, err := bot.pm.ImportPlugin(event.Nick, args[0], args[1], overwrite, checksum); err != nil {
+			bot.alertStaff(fmt.Sprintf("ALERT: %s tried to use !import with %s and got this error: %s", event.Nick, args[0], err.Error()))
 		} else {
-			bot.ShowCommandHelp(event.Arguments[0], event.Nick, args[0])
+			bot.alertStaff(fmt.Sprintf("ALERT: %s successfully used !import with %s: %s", event.Nick, args[0], manifest.Summary(bot.cfg.PluginGrants(args[1]))))
 		}
-	case ok && command == "!import" && len(args) >= 2 && bot.cfg.Irc.StaffChannel == event.Arguments[0]:
-		if privs.Owner {
-			overwrite := false
-			if len(args) == 3 {
-				overwrite = args[2] == "overwrite"
-			}
-			if err := bot.pm.ImportPlugin(event.Nick, args[0], args[1], overwrite); err != nil {
-				bot.conn.Privmsg(bot.cfg.Irc.StaffChannel, fmt.Sprintf("ALERT: %s tried to use !import with %s and got this error: %s", event.Nick, args[0], err.Error()))
+	case command == "plugin" && len(args) > 0 && bot.isStaffChannel(event.Arguments[0]) && bot.permitted(event, "plugin"):
+		bot.PluginCommand(event, prefix, args)
+	case command == "debug" && bot.isStaffChannel(event.Arguments[0]) && bot.permitted(event, "debug"):
+		switch {
+		case len(args) > 0 && args[0] == "on":
+			port, alreadyRunning := debug.StartDebugServer()
+			if alreadyRunning {
+				bot.queue.Privmsg(event.Arguments[0], fmt.Sprintf("%s: Debug server running on port %s", event.Nick, port))
 			} else {
-				bot.conn.Privmsg(bot.cfg.Irc.StaffChannel, fmt.Sprintf("ALERT: %s successfully used !import with %s", event.Nick, args[0]))
+				bot.queue.Privmsg(event.Arguments[0], fmt.Sprintf("%s: Debug server started on port %s", event.Nick, port))
 			}
-		} else {
-			utils.IRCAction(bot.conn, event.Arguments[0], fmt.Sprintf("slaps %s's hands away from the op only controls", event.Nick))
+			bot.cfg.Debug = true
+		case len(args) > 0 && args[0] == "off":
+			debug.StopDebugServer()
+			bot.queue.Privmsg(event.Arguments[0], fmt.Sprintf("%s: Debug server stopped", event.Nick))
+			bot.cfg.Debug = false
+		case len(args) > 0 && args[0] == "status":
+			status := debug.DebugServerStatus()
+			bot.queue.Privmsg(event.Arguments[0], fmt.Sprintf("%s: Debug server is %s", event.Nick, status))
+		default:
+			bot.queue.Privmsg(event.Arguments[0], fmt.Sprintf("%s: usage - %sdebug [on|off]", event.Nick, prefix))
 		}
-	case ok && command == "!debug" && bot.cfg.Irc.StaffChannel == event.Arguments[0]:
-		if privs.Owner || privs.Admin || privs.Op {
-			switch {
-			case len(args) > 0 && args[0] == "on":
-				port, alreadyRunning := debug.StartDebugServer()
-				if alreadyRunning {
-					bot.conn.Privmsg(bot.cfg.Irc.StaffChannel, fmt.Sprintf("%s: Debug server running on port %s", event.Nick, port))
-				} else {
-					bot.conn.Privmsg(bot.cfg.Irc.StaffChannel, fmt.Sprintf("%s: Debug server started on port %s", event.Nick, port))
-				}
-				bot.cfg.Debug = true
-			case len(args) > 0 && args[0] == "off":
-				debug.StopDebugServer()
-				bot.conn.Privmsg(bot.cfg.Irc.StaffChannel, fmt.Sprintf("%s: Debug server stopped", event.Nick))
-				bot.cfg.Debug = false
-			case len(args) > 0 && args[0] == "status":
-				status := debug.DebugServerStatus()
-				bot.conn.Privmsg(bot.cfg.Irc.StaffChannel, fmt.Sprintf("%s: Debug server is %s", event.Nick, status))
-			default:
-				bot.conn.Privmsg(bot.cfg.Irc.StaffChannel, fmt.Sprintf("%s: usage - !debug [on|off]", event.Nick))
+		bot.conn.VerboseCallbackHandler = bot.cfg.Debug
+	}
+}
+
+// Whether the sender of the event has the permission, telling them off
+// when they don't
+func (bot *Bot) permitted(event *irc.Event, permission string) bool {
+	if bot.perms.Can(event.Arguments[0], event.Source, permission) {
+		return true
+	}
+	bot.perms.Deny(bot.queue, event.Arguments[0], event.Nick)
+	return false
+}
+
+// Handler for !plugin list|load|unload|reload|enable|disable|rollback [name]
+func (bot *Bot) PluginCommand(event *irc.Event, prefix string, args []string) {
+	source := event.Arguments[0]
+	if args[0] == "list" {
+		plugins := bot.pm.Plugins()
+		names := make([]string, 0, len(plugins))
+		for _, plugin := range plugins {
+			name := plugin.Name
+			if plugin.Manifest.Version != "" {
+				name += " " + plugin.Manifest.Version
 			}
-			bot.conn.VerboseCallbackHandler = bot.cfg.Debug
-		} else {
-			utils.IRCAction(bot.conn, event.Arguments[0], fmt.Sprintf("slaps %s's hands away from the op only controls", event.Nick))
+			if plugin.Disabled {
+				name += " (disabled)"
+			}
+			names = append(names, name)
 		}
+		bot.queue.Privmsg(source, fmt.Sprintf("%s: loaded plugins are: %s", event.Nick, strings.Join(names, ", ")))
+		return
+	}
+	if len(args) != 2 {
+		bot.ShowCommandHelp(source, event.Nick, prefix, "plugin")
+		return
+	}
+
+	var err error
+	var done string
+	switch name := args[1]; args[0] {
+	case "load":
+		err, done = bot.pm.LoadPlugin(name), "loaded"
+	case "unload":
+		err, done = bot.pm.UnloadPlugin(name), "unloaded"
+	case "reload":
+		err, done = bot.pm.ReloadPlugin(name), "reloaded"
+	case "enable":
+		err, done = bot.pm.SetPluginDisabled(name, false), "enabled"
+	case "disable":
+		err, done = bot.pm.SetPluginDisabled(name, true), "disabled"
+	case "rollback":
+		err, done = bot.pm.RollbackPlugin(name), "rolled back"
+	default:
+		bot.ShowCommandHelp(source, event.Nick, prefix, "plugin")
+		return
+	}
+
+	if err != nil {
+		bot.alertStaff(fmt.Sprintf("ALERT: %s tried to %s plugin %s and got this error: %s", event.Nick, args[0], args[1], err.Error()))
+	} else {
+		utils.IRCAction(bot.queue, source, fmt.Sprintf("has %s plugin %s", done, args[1]))
+	}
+}
+
+// Whether the channel is configured as a staff channel
+func (bot *Bot) isStaffChannel(channel string) bool {
+	settings, ok := bot.state.ChannelConfig(channel)
+	return ok && settings.Role == config.StaffRole
+}
+
+// Sends a message to every staff channel
+func (bot *Bot) alertStaff(message string) {
+	for _, channel := range bot.cfg.ChannelsWithRole(config.StaffRole) {
+		bot.queue.Privmsg(channel.Name, message)
 	}
 }
 
 // Handler for reclaiming a stolen nick
 func (bot *Bot) ReclaimNick(event *irc.Event) {
-	if thief := bot.state.GetNick(bot.cfg.Irc.Nick); thief != nil {
+	// Still registering, so settle for another nick until registered
+	if event.Arguments[0] == unregisteredNick {
+		if len(event.Arguments) > 2 {
+			bot.queue.Nick(event.Arguments[1] + "_")
+		}
+		return
+	}
+
+	if _, thief := bot.state.GetNick(bot.cfg.Irc.Nick); thief {
 		// Recover nick from thieves
-		bot.conn.Privmsg("NickServ", fmt.Sprintf("RECOVER %s %s", bot.cfg.Irc.Nick, bot.cfg.Irc.NickPass))
+		bot.queue.Privmsg("NickServ", fmt.Sprintf("RECOVER %s %s", bot.cfg.Irc.Nick, bot.cfg.Irc.NickPass))
 		time.Sleep(time.Second)
-		bot.conn.Privmsg("NickServ", fmt.Sprintf("RELEASE %s %s", bot.cfg.Irc.Nick, bot.cfg.Irc.NickPass))
+		bot.queue.Privmsg("NickServ", fmt.Sprintf("RELEASE %s %s", bot.cfg.Irc.Nick, bot.cfg.Irc.NickPass))
 	}
 	bot.SetBotState(event)
 }
 
-// Automatically give voice to users in channels in which the bot has Op
+// Automatically give voice to users in auto-voice channels in which the
+// bot has Op
 func (bot *Bot) AutoVoice(event *irc.Event) {
-	if bot.cfg.Irc.AutoVoice {
+	if settings, ok := bot.state.ChannelConfig(event.Arguments[0]); ok && settings.AutoVoice {
 		time.Sleep(time.Second) // Wait a second before we bother
 
 		privs, ok := bot.state.GetPrivs(event.Arguments[0], bot.conn.GetNick())
@@ -126,7 +204,7 @@ func (bot *Bot) AutoVoice(event *irc.Event) {
 			}
 
 			// Set mode
-			bot.conn.Mode(event.Arguments[0], fmt.Sprintf("+v %s", event.Nick))
+			bot.state.SetModes(event.Arguments[0], state.ModeChange{Set: true, Mode: 'v', Arg: event.Nick})
 		} else {
 			// We can't grant voice yet
 			bot.conn.Log.Printf("I don't have the privileges to grant voice in channel %s", event.Arguments[0])
@@ -140,16 +218,18 @@ func (bot *Bot) VoiceAll(event *irc.Event) {
 
 	// Do we current have the rights for voicing people?
 	if ok && (privs.Owner || privs.Admin || privs.Op || privs.HalfOp) {
-		if channel := bot.state.GetChannel(event.Arguments[0]); channel != nil {
-			for nick, privs := range channel.Nicks {
+		if channel, ok := bot.state.GetChannel(event.Arguments[0]); ok {
+			changes := make([]state.ModeChange, 0)
+			for _, privs := range channel.Nicks {
 				// No need to autovoice
-				if privs != nil && (privs.Owner || privs.Admin || privs.Op || privs.HalfOp || privs.Voice) {
+				if privs.Owner || privs.Admin || privs.Op || privs.HalfOp || privs.Voice {
 					continue
 				}
-
-				// Set mode
-				bot.conn.Mode(event.Arguments[0], fmt.Sprintf("+v %s", nick))
+				changes = append(changes, state.ModeChange{Set: true, Mode: 'v', Arg: privs.Name})
 			}
+
+			// Set modes, batched as far as the server allows
+			bot.state.SetModes(event.Arguments[0], changes...)
 		}
 	} else {
 		// We can't grant voice yet
@@ -157,21 +237,60 @@ func (bot *Bot) VoiceAll(event *irc.Event) {
 	}
 }
 
+// Gives or takes op from the nicks
+func (bot *Bot) OpNicks(channel string, op bool, nicks []string) {
+	if !bot.state.ServerInfo().IsChannel(channel) {
+		return
+	}
+
+	changes := make([]state.ModeChange, 0, len(nicks))
+	for _, nick := range nicks {
+		changes = append(changes, state.ModeChange{Set: op, Mode: 'o', Arg: nick})
+	}
+	bot.state.SetModes(channel, changes...)
+}
+
+// Bans or unbans the masks, nicks being turned into a mask on their host
+func (bot *Bot) BanMasks(channel string, ban bool, masks []string) {
+	if !bot.state.ServerInfo().IsChannel(channel) {
+		return
+	}
+
+	changes := make([]state.ModeChange, 0, len(masks))
+	for _, mask := range masks {
+		changes = append(changes, state.ModeChange{Set: ban, Mode: 'b', Arg: bot.banMask(mask)})
+	}
+	bot.state.SetModes(channel, changes...)
+}
+
+// Returns the ban mask for a nick, or the mask itself when given one
+func (bot *Bot) banMask(mask string) string {
+	if strings.ContainsAny(mask, "!@*?") {
+		return mask
+	}
+	if nick, ok := bot.state.GetNick(mask); ok && nick.Host != "" {
+		return fmt.Sprintf("*!*@%s", nick.Host)
+	}
+	return fmt.Sprintf("%s!*@*", mask)
+}
+
 // Function for setting up the botstate
 func (bot *Bot) SetBotState(event *irc.Event) {
-	if ghost := bot.state.GetNick(bot.cfg.Irc.Nick); ghost != nil && ghost != bot.state.Me() {
+	if _, ghost := bot.state.GetNick(bot.cfg.Irc.Nick); ghost && !bot.state.EqualFold(bot.cfg.Irc.Nick, bot.conn.GetNick()) {
 		// GHOST the old nick
-		bot.conn.Privmsg("NickServ", fmt.Sprintf("GHOST %s %s", bot.cfg.Irc.Nick, bot.cfg.Irc.NickPass))
+		bot.queue.Privmsg("NickServ", fmt.Sprintf("GHOST %s %s", bot.cfg.Irc.Nick, bot.cfg.Irc.NickPass))
 	}
 
 	// Set up the nick
-	bot.conn.Nick(bot.cfg.Irc.Nick)
+	bot.queue.Nick(bot.cfg.Irc.Nick)
 
-	// Identify as the nick owner
-	bot.conn.Privmsg("NickServ", fmt.Sprintf("IDENTIFY %s", bot.cfg.Irc.NickPass))
+	// Identify as the nick owner, unless SASL already took care of it
+	if !bot.SaslAuthenticated() && bot.cfg.Irc.NickPass != "" {
+		bot.queue.Privmsg("NickServ", fmt.Sprintf("IDENTIFY %s", bot.cfg.Irc.NickPass))
+	}
 
 	// Tell IRC I'm a bot
-	bot.conn.Mode(bot.cfg.Irc.Nick, "+B")
+	bot.queue.Mode(bot.cfg.Irc.Nick, "+B")
 }
 
 // Function for re-joining channels
@@ -179,55 +298,65 @@ func (bot *Bot) JoinChannels(event *irc.Event) {
 	time.Sleep(time.Second) // Wait a second before we bother
 
 	// Was I kicked?
-	kickedFromNormal := event.Code == "KICK" && event.Arguments[1] == bot.state.Me().Nick && event.Arguments[0] == bot.cfg.Irc.NormalChannel
-	kickedFromStaff := event.Code == "KICK" && event.Arguments[1] == bot.state.Me().Nick && event.Arguments[0] == bot.cfg.Irc.StaffChannel
+	kicked := event.Code == "KICK" && bot.state.EqualFold(event.Arguments[1], bot.conn.GetNick())
 
-	if _, ok := bot.state.GetPrivs(bot.cfg.Irc.NormalChannel, bot.state.Me().Nick); !ok || kickedFromNormal {
-		bot.conn.Join(bot.cfg.Irc.NormalChannel)
-	}
-
-	if _, ok := bot.state.GetPrivs(bot.cfg.Irc.StaffChannel, bot.state.Me().Nick); !ok || kickedFromStaff {
-		bot.conn.Join(bot.cfg.Irc.StaffChannel)
+	for _, channel := range bot.cfg.Channel {
+		kickedFromChannel := kicked && bot.state.EqualFold(event.Arguments[0], channel.Name)
+		if _, ok := bot.state.GetPrivs(channel.Name, bot.conn.GetNick()); !ok || kickedFromChannel {
+			bot.queue.Join(channel.Name, channel.Key)
+		}
 	}
 }
 
-// Print out the commands available
-func (bot *Bot) ShowCommandList(source, nick string) {
+// Print out the commands available, shown with prefix
+func (bot *Bot) ShowCommandList(source, nick, prefix string) {
 	var commands []string = make([]string, 0)
-	commands = append(commands, "!reload", "!ping", "!quit", "!help", "!import", "!debug", "!voice", "!rejoin")
+	for _, cmd := range []string{"reload", "ping", "quit", "help", "import", "debug", "voice", "op", "deop", "ban", "unban", "rejoin", "plugin"} {
+		commands = append(commands, prefix+cmd)
+	}
 
-	for cmd, _ := range bot.pm.CommandHelp() {
+	for cmd, _ := range bot.pm.CommandHelp(prefix) {
 		commands = append(commands, cmd)
 	}
 	sort.Strings(commands)
-	bot.conn.Privmsg(source, fmt.Sprintf("%s: available commands are: %s", nick, strings.Join(commands, ", ")))
+	bot.queue.Privmsg(source, fmt.Sprintf("%s: available commands are: %s", nick, strings.Join(commands, ", ")))
 }
 
-// Print out the commands available
-func (bot *Bot) ShowCommandHelp(source, nick, cmd string) {
-	message := "unknown command, run `!help` to see what commands are available."
+// Print out the help of a command, shown with prefix
+func (bot *Bot) ShowCommandHelp(source, nick, prefix, cmd string) {
+	message := fmt.Sprintf("unknown command, run `%shelp` to see what commands are available.", prefix)
 	switch cmd {
-	case "!ping":
-		message = fmt.Sprintf("makes `%s` reply with PONG!", bot.state.Me().Nick)
-	case "!reload":
+	case "ping":
+		message = fmt.Sprintf("makes `%s` reply with PONG!", bot.conn.GetNick())
+	case "reload":
 		message = "reloads the plugins"
-	case "!quit":
-		message = fmt.Sprintf("makes `%s` quit IRC", bot.state.Me().Nick)
-	case "!help":
+	case "quit":
+		message = fmt.Sprintf("makes `%s` quit IRC", bot.conn.GetNick())
+	case "help":
 		message = "shows this message, smart ass"
-	case "!voice":
+	case "voice":
 		message = "grants voice to everyone in the channel who doesn't already have it"
-	case "!import":
-		message = "call like !import [url] [name] [overwrite], imports the plugin at [url] into [name].js and loads it into the bot. Will not overwrite unless [overwrite] is set to 'overwrite'"
-	case "!debug":
+	case "op":
+		message = fmt.Sprintf("call like %sop [nick]..., gives op to the nicks", prefix)
+	case "deop":
+		message = fmt.Sprintf("call like %sdeop [nick]..., takes op from the nicks", prefix)
+	case "ban":
+		message = fmt.Sprintf("call like %sban [nick|mask]..., bans the masks, or the hosts of the nicks", prefix)
+	case "unban":
+		message = fmt.Sprintf("call like %[1]sunban [nick|mask]..., lifts bans set with %[1]sban", prefix)
+	case "import":
+		message = fmt.Sprintf("call like %simport [url] [name] [overwrite] [sha256:checksum], imports the plugin at [url] into [name].js and loads it into the bot. Will not overwrite unless [overwrite] is set to 'overwrite', and refuses plugins not matching the checksum when given. A plugin failing to load is rolled back", prefix)
+	case "plugin":
+		message = fmt.Sprintf("call like %[1]splugin list, or %[1]splugin [load|unload|reload|enable|disable|rollback] [name], manages a single plugin without touching the others. Disabled plugins stay disabled across restarts, and rollback puts back the version the last %[1]simport replaced", prefix)
+	case "debug":
 		message = "starts/stops debugging server for inspecting the bot"
-	case "!rejoin":
-		message = "makes the bot rejoin it's standard channels. Only works via PM."
+	case "rejoin":
+		message = "makes the bot rejoin its configured channels. Only works via PM."
 	default:
-		if help, ok := bot.pm.CommandHelp()[cmd]; ok {
+		if help, ok := bot.pm.CommandHelp(prefix)[prefix+cmd]; ok {
 			message = help
 		}
 	}
 
-	bot.conn.Privmsg(source, fmt.Sprintf("%s: %s - %s", nick, cmd, message))
+	bot.queue.Privmsg(source, fmt.Sprintf("%s: %s%s - %s", nick, prefix, cmd, message))
 }
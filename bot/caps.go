@@ -0,0 +1,170 @@
+package bot
+
+import (
+	"strings"
+
+	"github.com/thoj/go-ircevent"
+)
+
+// Capabilities requested when none are configured
+var defaultCaps = []string{
+	"server-time",
+	"account-notify",
+	"away-notify",
+	"extended-join",
+	"multi-prefix",
+	"userhost-in-names",
+	"chghost",
+	"message-tags",
+}
+
+// Max length of the capability list in a single CAP REQ
+const capReqSize = 400
+
+// Nick go-ircevent registers with when connecting. Servers reject it, so
+// registration can't complete before the bot sends its real nick after
+// CAP LS, which makes the server hold registration until CAP END.
+const unregisteredNick = "*"
+
+// Returns the capabilities the bot wants from the server
+func (bot *Bot) wantedCaps() []string {
+	caps := bot.cfg.Irc.Caps
+	if caps == nil {
+		caps = defaultCaps
+	}
+	if bot.cfg.Irc.Sasl {
+		caps = append(caps[:len(caps):len(caps)], "sasl")
+	}
+	return caps
+}
+
+// Starts capability negotiation and registration. Must be called straight
+// after connecting, go-ircevent having only sent a NICK the server rejects.
+func (bot *Bot) StartCapNegotiation() {
+	bot.capNegotiating = true
+	bot.capsAvailable = make(map[string]string)
+	bot.capsRequested = 0
+	bot.state.Caps().Clear()
+
+	bot.setSaslStatus(saslIdle)
+	if bot.cfg.Irc.Sasl {
+		bot.setSaslStatus(saslPending)
+	}
+
+	bot.queue.SendRaw("CAP LS 302")
+	bot.queue.Nick(bot.cfg.Irc.Nick)
+}
+
+// Finishes capability negotiation and lets registration carry on
+func (bot *Bot) EndCapNegotiation() {
+	if bot.capNegotiating {
+		bot.capNegotiating = false
+		bot.queue.SendRaw("CAP END")
+	}
+}
+
+// Handler for CAP replies from the server
+func (bot *Bot) HandleCap(event *irc.Event) {
+	if len(event.Arguments) < 3 {
+		return
+	}
+
+	caps := strings.Fields(event.Arguments[len(event.Arguments)-1])
+	switch event.Arguments[1] {
+	case "LS":
+		for _, c := range caps {
+			name, value := splitCap(c)
+			bot.capsAvailable[name] = value
+		}
+
+		// Multiline replies flag every line but the last with *
+		if len(event.Arguments) > 3 && event.Arguments[2] == "*" {
+			return
+		}
+		if bot.capNegotiating {
+			bot.requestCaps(bot.capsAvailable)
+		}
+	case "NEW":
+		available := make(map[string]string)
+		for _, c := range caps {
+			name, value := splitCap(c)
+			bot.capsAvailable[name] = value
+			available[name] = value
+		}
+		bot.requestCaps(available)
+	case "DEL":
+		for _, c := range caps {
+			name, _ := splitCap(c)
+			delete(bot.capsAvailable, name)
+			bot.state.Caps().Disable(name)
+			bot.conn.Log.Printf("Server removed capability %s", name)
+		}
+	case "ACK":
+		for _, c := range caps {
+			if strings.HasPrefix(c, "-") {
+				bot.state.Caps().Disable(c[1:])
+				continue
+			}
+			name, _ := splitCap(c)
+			bot.state.Caps().Enable(name, bot.capsAvailable[name])
+			if name == "sasl" {
+				bot.StartSasl()
+			}
+		}
+		bot.capsRequested--
+		bot.capDone()
+	case "NAK":
+		bot.conn.Log.Printf("Server refused capabilities: %s", strings.Join(caps, ", "))
+		for _, c := range caps {
+			if c == "sasl" {
+				bot.saslFail("server refused the sasl capability")
+			}
+		}
+		bot.capsRequested--
+		bot.capDone()
+	}
+}
+
+// Sends CAP REQ for every wanted capability the server has available
+func (bot *Bot) requestCaps(available map[string]string) {
+	var request []string
+	for _, name := range bot.wantedCaps() {
+		if _, ok := available[name]; ok && !bot.state.HasCap(name) {
+			request = append(request, name)
+		}
+	}
+
+	// Keep each request line well under the 512 byte limit
+	for len(request) > 0 {
+		i, size := 0, 0
+		for ; i < len(request) && (i == 0 || size+len(request[i])+1 <= capReqSize); i++ {
+			size += len(request[i]) + 1
+		}
+		bot.capsRequested++
+		bot.queue.SendRawf("CAP REQ :%s", strings.Join(request[:i], " "))
+		request = request[i:]
+	}
+
+	if _, ok := available["sasl"]; bot.capNegotiating && !ok && bot.saslStatusIs(saslPending) {
+		bot.saslFail("server does not support SASL")
+		return
+	}
+
+	bot.capDone()
+}
+
+// Ends negotiation once every CAP REQ has been answered and SASL is no
+// longer in progress
+func (bot *Bot) capDone() {
+	if bot.capsRequested <= 0 && !bot.saslStatusIs(saslPending) {
+		bot.EndCapNegotiation()
+	}
+}
+
+// Splits an advertised capability into its name and value
+func splitCap(c string) (name, value string) {
+	if idx := strings.Index(c, "="); idx != -1 {
+		return c[:idx], c[idx+1:]
+	}
+	return c, ""
+}
@@ -0,0 +1,104 @@
+package bot
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/thoj/go-ircevent"
+)
+
+// Delay before the first reconnect attempt, doubled on each failure
+const reconnectBaseDelay = 2 * time.Second
+
+// Longest delay between reconnect attempts
+const reconnectMaxDelay = 5 * time.Minute
+
+// Code of the synthetic event dispatched once the bot is registered again
+// after a reconnect
+const ReconnectedEvent = "RECONNECTED"
+
+// Returns how long to wait before the next reconnect attempt, somewhere
+// between half and all of the exponential backoff delay
+func reconnectDelay(failures int) time.Duration {
+	delay := reconnectMaxDelay
+	if failures < 16 {
+		if d := reconnectBaseDelay << uint(failures); d < reconnectMaxDelay {
+			delay = d
+		}
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Waits for the connection to drop and reconnects, giving up once
+// MaxFailures attempts in a row have failed
+func (bot *Bot) watchConnection() {
+	for {
+		err := <-bot.conn.ErrorChan()
+		if atomic.LoadInt32(&bot.quitting) == 1 {
+			return
+		}
+		bot.conn.Log.Printf("Disconnected: %s", err)
+
+		if !bot.reconnect() {
+			bot.Quitted <- true
+			return
+		}
+	}
+}
+
+// Reconnects with backoff, returning false when out of attempts
+func (bot *Bot) reconnect() bool {
+	for {
+		failures := atomic.AddInt32(&bot.failures, 1)
+		if bot.cfg.Irc.MaxFailures > 0 && int(failures) > bot.cfg.Irc.MaxFailures {
+			bot.conn.Log.Printf("Giving up after %d failed connection attempts", failures-1)
+			return false
+		}
+
+		delay := reconnectDelay(int(failures) - 1)
+		bot.conn.Log.Printf("Reconnecting in %s (attempt %d)", delay, failures)
+		time.Sleep(delay)
+
+		if atomic.LoadInt32(&bot.quitting) == 1 {
+			return false
+		}
+
+		// Nothing we knew about the old connection holds any more
+		bot.queue.Clear()
+		bot.state.Reset()
+		atomic.StoreInt32(&bot.reconnecting, 1)
+
+		if err := bot.conn.Reconnect(); err != nil {
+			bot.conn.Log.Printf("Reconnect failed: %s", err)
+			continue
+		}
+		bot.StartCapNegotiation()
+		return true
+	}
+}
+
+// Handler for registration, resetting the failure count and letting
+// plugins know when this was a reconnect. The nick comes from the event,
+// go-ircevent possibly not having seen it yet.
+func (bot *Bot) Registered(event *irc.Event) {
+	atomic.StoreInt32(&bot.failures, 0)
+
+	// Servers without capability negotiation register without waiting
+	// for CAP END
+	if bot.capNegotiating {
+		bot.capNegotiating = false
+		if bot.saslStatusIs(saslPending) {
+			bot.saslFail("server does not support capabilities")
+		}
+	}
+
+	if atomic.CompareAndSwapInt32(&bot.reconnecting, 1, 0) {
+		bot.conn.RunCallbacks(&irc.Event{
+			Code:      ReconnectedEvent,
+			Raw:       ReconnectedEvent,
+			Nick:      event.Arguments[0],
+			Arguments: []string{event.Arguments[0]},
+		})
+	}
+}
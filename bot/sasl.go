@@ -0,0 +1,149 @@
+package bot
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/thoj/go-ircevent"
+)
+
+// SASL negotiation progress
+const (
+	saslIdle = iota
+	saslPending
+	saslSucceeded
+	saslFailed
+)
+
+// Max length of a single AUTHENTICATE payload chunk
+const saslChunkSize = 400
+
+// Loads the TLS client certificate used for SASL EXTERNAL
+func loadClientCert(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// Returns the AUTHENTICATE lines answering the server's challenge for
+// mech. EXTERNAL takes the identity from the TLS client certificate, PLAIN
+// sends the login and password.
+func saslResponse(mech, login, pass string) ([]string, error) {
+	switch mech {
+	case "EXTERNAL":
+		return []string{"AUTHENTICATE +"}, nil
+	case "PLAIN":
+		payload := fmt.Sprintf("%s\x00%s\x00%s", login, login, pass)
+		encoded := base64.StdEncoding.EncodeToString([]byte(payload))
+
+		// Payloads are sent in 400 byte chunks, terminated by an empty
+		// one if the last chunk was full
+		var lines []string
+		for len(encoded) >= saslChunkSize {
+			lines = append(lines, "AUTHENTICATE "+encoded[:saslChunkSize])
+			encoded = encoded[saslChunkSize:]
+		}
+		if encoded == "" {
+			encoded = "+"
+		}
+		return append(lines, "AUTHENTICATE "+encoded), nil
+	}
+	return nil, fmt.Errorf("unsupported SASL mechanism %s, only PLAIN and EXTERNAL are supported", mech)
+}
+
+// Whether mech is in the comma separated list of mechanisms a server
+// advertised with the sasl capability, an empty list telling nothing
+func saslMechSupported(mechs, mech string) bool {
+	if mechs == "" {
+		return true
+	}
+	for _, m := range strings.Split(mechs, ",") {
+		if strings.EqualFold(m, mech) {
+			return true
+		}
+	}
+	return false
+}
+
+// Starts SASL authentication once the server acknowledged the sasl
+// capability
+func (bot *Bot) StartSasl() {
+	if !bot.saslStatusIs(saslPending) {
+		return
+	}
+
+	if mechs, _ := bot.state.Caps().Value("sasl"); !saslMechSupported(mechs, bot.cfg.Irc.SaslMech) {
+		bot.saslFail(fmt.Sprintf("server only supports %s", mechs))
+		return
+	}
+
+	bot.queue.SendRawf("AUTHENTICATE %s", bot.cfg.Irc.SaslMech)
+}
+
+// Handler for the server's AUTHENTICATE challenge
+func (bot *Bot) SaslAuthenticate(event *irc.Event) {
+	if !bot.saslStatusIs(saslPending) || len(event.Arguments) == 0 || event.Arguments[0] != "+" {
+		return
+	}
+
+	lines, err := saslResponse(bot.cfg.Irc.SaslMech, bot.cfg.Irc.SaslLogin, bot.cfg.Irc.SaslPass)
+	if err != nil {
+		bot.queue.SendRaw("AUTHENTICATE *")
+		bot.saslFail(err.Error())
+		return
+	}
+	for _, line := range lines {
+		bot.queue.SendRaw(line)
+	}
+}
+
+// Handler for the SASL numerics: 903 on success, 902, 904, 905 and 906
+// when authentication failed or was aborted
+func (bot *Bot) SaslResult(event *irc.Event) {
+	if !bot.saslStatusIs(saslPending) {
+		return
+	}
+
+	if event.Code == "903" {
+		bot.setSaslStatus(saslSucceeded)
+		bot.conn.Log.Printf("SASL %s authentication succeeded", bot.cfg.Irc.SaslMech)
+		bot.capDone()
+		return
+	}
+	bot.saslFail(event.Message())
+}
+
+// Ends SASL negotiation after a failure, either carrying on with
+// registration so NickServ can be used or refusing to connect at all
+func (bot *Bot) saslFail(reason string) {
+	bot.setSaslStatus(saslFailed)
+	bot.conn.Log.Printf("SASL %s authentication failed: %s", bot.cfg.Irc.SaslMech, reason)
+
+	if bot.cfg.Irc.SaslRequired {
+		bot.conn.Log.Printf("SASL is required, refusing to connect")
+		bot.Quit()
+		return
+	}
+
+	bot.conn.Log.Printf("Falling back to NickServ identification")
+	bot.capDone()
+}
+
+func (bot *Bot) setSaslStatus(status int32) {
+	atomic.StoreInt32(&bot.saslStatus, status)
+}
+
+func (bot *Bot) saslStatusIs(status int32) bool {
+	return atomic.LoadInt32(&bot.saslStatus) == status
+}
+
+// Whether the bot is logged in through SASL, in which case NickServ
+// identification is not required
+func (bot *Bot) SaslAuthenticated() bool {
+	return bot.saslStatusIs(saslSucceeded)
+}
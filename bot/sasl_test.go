@@ -0,0 +1,88 @@
+package bot
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSaslResponse(t *testing.T) {
+	tests := []struct {
+		mech string
+		want []string
+	}{
+		{"EXTERNAL", []string{"AUTHENTICATE +"}},
+		{"PLAIN", []string{"AUTHENTICATE Ym90AGJvdABzZWNyZXQ="}},
+		{"SCRAM-SHA-256", nil},
+	}
+
+	for _, test := range tests {
+		got, err := saslResponse(test.mech, "bot", "secret")
+		if (err == nil) != (test.want != nil) {
+			t.Errorf("saslResponse(%q) gave error %v", test.mech, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("saslResponse(%q) = %q, want %q", test.mech, got, test.want)
+		}
+	}
+}
+
+func TestSaslResponseChunks(t *testing.T) {
+	tests := []struct {
+		name   string
+		login  string
+		pass   string
+		chunks int
+	}{
+		{"one chunk", "bot", "secret", 1},
+		{"several chunks", strings.Repeat("x", 300), "secret", 3},
+		// 900 bytes encode to exactly three full chunks
+		{"ending on a full chunk", strings.Repeat("x", 300), strings.Repeat("x", 298), 4},
+	}
+
+	for _, test := range tests {
+		lines, err := saslResponse("PLAIN", test.login, test.pass)
+		if err != nil {
+			t.Errorf("%s: saslResponse failed: %s", test.name, err)
+			continue
+		}
+		if len(lines) != test.chunks {
+			t.Errorf("%s: got %d lines, want %d", test.name, len(lines), test.chunks)
+		}
+
+		encoded := ""
+		for i, line := range lines {
+			chunk := strings.TrimPrefix(line, "AUTHENTICATE ")
+			if i < len(lines)-1 && len(chunk) != saslChunkSize {
+				t.Errorf("%s: line %d has a %d byte chunk, want %d", test.name, i, len(chunk), saslChunkSize)
+			}
+			if chunk != "+" {
+				encoded += chunk
+			}
+		}
+		payload, err := base64.StdEncoding.DecodeString(encoded)
+		if want := test.login + "\x00" + test.login + "\x00" + test.pass; err != nil || string(payload) != want {
+			t.Errorf("%s: payload decodes to %q (%v), want %q", test.name, payload, err, want)
+		}
+	}
+}
+
+func TestSaslMechSupported(t *testing.T) {
+	tests := []struct {
+		mechs, mech string
+		want        bool
+	}{
+		{"", "EXTERNAL", true},
+		{"PLAIN,EXTERNAL", "EXTERNAL", true},
+		{"PLAIN,EXTERNAL", "PLAIN", true},
+		{"plain", "PLAIN", true},
+		{"PLAIN,SCRAM-SHA-256", "EXTERNAL", false},
+	}
+
+	for _, test := range tests {
+		if got := saslMechSupported(test.mechs, test.mech); got != test.want {
+			t.Errorf("saslMechSupported(%q, %q) = %t, want %t", test.mechs, test.mech, got, test.want)
+		}
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 )
 
 type (
@@ -17,24 +19,269 @@ type (
 		Username      string
 		Pass          string
 		Ssl           bool
-		NormalChannel string
-		StaffChannel  string
+		SslCert       string
+		SslKey        string
+		Sasl          bool
+		SaslMech      string
+		SaslLogin     string
+		SaslPass      string
+		SaslRequired  bool
+		Caps          []string
+		FloodBurst    int
+		FloodRate     float64
+		NormalChannel string // Deprecated, use [[Channel]]
+		StaffChannel  string // Deprecated, use [[Channel]]
 		MaxFailures   int
 		Timeout       uint
 		KeepAlive     uint
 		PingFreq      uint
-		AutoVoice     bool
+		AutoVoice     bool // Deprecated, use [[Channel]]
 		Version       string
 		Debug         bool
 		PluginsDir    string
+		CommandPrefix []string // Prefixes commands start with, ! by default
+		StorePath     string   // JSON file plugins keep their data in
+		WatchPlugins  bool     // Reload plugins as their files change
+		ImportMaxSize int64    // Largest plugin !import downloads, in bytes
+		PluginHistory int      // Versions replaced by !import kept per plugin
+
+		// Seconds a plugin command or callback may run (0 for no limit),
+		// and timeouts in a row before the plugin gets disabled (0 to
+		// never disable it)
+		PluginTimeout     uint
+		PluginMaxTimeouts int
+	}
+
+	// A role is held by anyone matching one of its services accounts,
+	// hostmasks or having at least the given channel status (voice,
+	// halfop, op, admin or owner) in the command's channel, or in one of
+	// Channels when set
+	RoleSettings struct {
+		Name        string
+		Accounts    []string
+		Hostmasks   []string
+		Status      string
+		Channels    []string
+		Permissions []string
+	}
+
+	// A channel the bot joins. Role is normal, staff (where privileged
+	// commands and alerts go) or announce (where announcements go).
+	// Plugins, when set, lists the only plugins seeing the channel, and
+	// DenyPlugins those that never do. Prefix replaces Irc.CommandPrefix
+	// in the channel.
+	ChannelSettings struct {
+		Name        string
+		Key         string
+		Role        string
+		AutoVoice   bool
+		Prefix      []string
+		Plugins     []string
+		DenyPlugins []string
+	}
+
+	// Capabilities granted to a plugin, named with or without its .js
+	// extension. A plugin only gets those it also requires in its
+	// manifest.
+	PluginSettings struct {
+		Name  string
+		Grant []string
+	}
+
+	// A network to connect to. Irc settings left out, credentials aside,
+	// and the channels and roles when none are given, are taken from the
+	// top level settings.
+	NetworkSettings struct {
+		Name    string
+		Irc     ircSettings
+		Channel []ChannelSettings
+		Role    []RoleSettings
 	}
 
 	Settings struct {
-		Irc   ircSettings
-		Debug bool
+		Name    string // Network name, defaults to the server host
+		Irc     ircSettings
+		Channel []ChannelSettings
+		Role    []RoleSettings
+		Network []NetworkSettings
+		Plugin  []PluginSettings
+		Debug   bool
+
+		networks []*Settings
 	}
 )
 
+// Returns the settings of every network to connect to
+func (cfg *Settings) Networks() []*Settings {
+	return cfg.networks
+}
+
+// Irc settings never taken from the top level settings, so one network's
+// credentials don't get sent to another
+var credentials = map[string]bool{
+	"NickPass":  true,
+	"Pass":      true,
+	"SaslLogin": true,
+	"SaslPass":  true,
+	"SslCert":   true,
+	"SslKey":    true,
+}
+
+// Returns the settings for a network, falling back on the top level
+// settings for the Irc settings it leaves out, according to defined
+func (cfg *Settings) networkSettings(network NetworkSettings, defined func(field string) bool) *Settings {
+	settings := &Settings{
+		Name:    network.Name,
+		Irc:     network.Irc,
+		Channel: network.Channel,
+		Role:    network.Role,
+		Plugin:  cfg.Plugin,
+		Debug:   cfg.Debug,
+	}
+
+	fields, defaults := reflect.ValueOf(&settings.Irc).Elem(), reflect.ValueOf(cfg.Irc)
+	for i := 0; i < fields.NumField(); i++ {
+		name := fields.Type().Field(i).Name
+		if !credentials[name] && !defined(name) {
+			fields.Field(i).Set(defaults.Field(i))
+		}
+	}
+
+	if len(settings.Channel) == 0 {
+		settings.Channel = append([]ChannelSettings(nil), cfg.Channel...)
+	}
+	if len(settings.Role) == 0 {
+		settings.Role = cfg.Role
+	}
+	return settings
+}
+
+// Returns the Irc settings each [[Network]] sets, in order. IsDefined
+// can't tell the tables of an array apart, so the keys are walked in the
+// order they appear in the file instead.
+func networksDefined(md toml.MetaData) []map[string]bool {
+	var defined []map[string]bool
+	for _, key := range md.Keys() {
+		switch {
+		case len(key) == 0 || !strings.EqualFold(key[0], "Network"):
+		case len(key) == 1:
+			defined = append(defined, make(map[string]bool))
+		case len(key) == 3 && strings.EqualFold(key[1], "Irc") && len(defined) > 0:
+			defined[len(defined)-1][strings.ToLower(key[2])] = true
+		}
+	}
+	return defined
+}
+
+// Fills in the defaults depending on other settings of the network
+func (cfg *Settings) applyDefaults() {
+	if cfg.Name == "" {
+		cfg.Name = cfg.Irc.Host
+	}
+
+	// SASL defaults to PLAIN with the NickServ credentials
+	if cfg.Irc.SaslMech == "" {
+		cfg.Irc.SaslMech = "PLAIN"
+	}
+	cfg.Irc.SaslMech = strings.ToUpper(cfg.Irc.SaslMech)
+	if cfg.Irc.SaslLogin == "" {
+		cfg.Irc.SaslLogin = cfg.Irc.Nick
+	}
+	if cfg.Irc.SaslPass == "" {
+		cfg.Irc.SaslPass = cfg.Irc.NickPass
+	}
+
+	// Channels are normal unless said otherwise
+	for i := range cfg.Channel {
+		switch cfg.Channel[i].Role = strings.ToLower(cfg.Channel[i].Role); cfg.Channel[i].Role {
+		case NormalRole, StaffRole, AnnounceRole:
+		case "":
+			cfg.Channel[i].Role = NormalRole
+		default:
+			log.Printf("Channel `%s` has unknown role `%s`, treating it as normal\n", cfg.Channel[i].Name, cfg.Channel[i].Role)
+			cfg.Channel[i].Role = NormalRole
+		}
+	}
+	cfg.migrateChannels()
+}
+
+// Channel roles
+const (
+	NormalRole   = "normal"
+	StaffRole    = "staff"
+	AnnounceRole = "announce"
+)
+
+// Returns the channels having the given role
+func (cfg *Settings) ChannelsWithRole(role string) []ChannelSettings {
+	channels := make([]ChannelSettings, 0)
+	for _, channel := range cfg.Channel {
+		if channel.Role == role {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// Whether the plugin may see the channel's events and commands, plugins
+// being named with or without their .js extension
+func (channel *ChannelSettings) AllowsPlugin(name string) bool {
+	name = strings.TrimSuffix(name, ".js")
+	for _, denied := range channel.DenyPlugins {
+		if strings.TrimSuffix(denied, ".js") == name {
+			return false
+		}
+	}
+	if len(channel.Plugins) == 0 {
+		return true
+	}
+	for _, allowed := range channel.Plugins {
+		if strings.TrimSuffix(allowed, ".js") == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the capabilities granted to the plugin
+func (cfg *Settings) PluginGrants(name string) []string {
+	name = strings.TrimSuffix(name, ".js")
+	for _, plugin := range cfg.Plugin {
+		if strings.TrimSuffix(plugin.Name, ".js") == name {
+			return plugin.Grant
+		}
+	}
+	return nil
+}
+
+// Turns the old NormalChannel and StaffChannel settings into channels, and
+// fills them in from the channels for plugins still reading them
+func (cfg *Settings) migrateChannels() {
+	legacy := []ChannelSettings{
+		{Name: cfg.Irc.NormalChannel, Role: NormalRole, AutoVoice: cfg.Irc.AutoVoice},
+		{Name: cfg.Irc.StaffChannel, Role: StaffRole, AutoVoice: cfg.Irc.AutoVoice},
+	}
+	for _, channel := range legacy {
+		if channel.Name == "" {
+			continue
+		}
+		known := false
+		for _, c := range cfg.Channel {
+			known = known || strings.EqualFold(c.Name, channel.Name)
+		}
+		if !known {
+			cfg.Channel = append(cfg.Channel, channel)
+		}
+	}
+
+	if normal := cfg.ChannelsWithRole(NormalRole); cfg.Irc.NormalChannel == "" && len(normal) > 0 {
+		cfg.Irc.NormalChannel = normal[0].Name
+	}
+	if staff := cfg.ChannelsWithRole(StaffRole); cfg.Irc.StaffChannel == "" && len(staff) > 0 {
+		cfg.Irc.StaffChannel = staff[0].Name
+	}
+}
+
 func Load() *Settings {
 	log.New(os.Stdout, "[config]", log.LstdFlags)
 
@@ -60,13 +307,68 @@ func Load() *Settings {
 	}
 
 	var cfg Settings
-	if _, err := toml.DecodeFile(configPath, &cfg); err != nil {
+	md, err := toml.DecodeFile(configPath, &cfg)
+	if err != nil {
 		log.Fatalln(err)
 	}
 
 	if cfg.Irc.PluginsDir == "" {
 		cfg.Irc.PluginsDir = filepath.Join(cwd, "js")
 	}
+	if len(cfg.Irc.CommandPrefix) == 0 {
+		cfg.Irc.CommandPrefix = []string{"!"}
+	}
+	if cfg.Irc.StorePath == "" {
+		cfg.Irc.StorePath = filepath.Join(cwd, "store.json")
+	}
+
+	// Imports are limited to 256KiB, and keep the last 5 versions
+	if cfg.Irc.ImportMaxSize <= 0 {
+		cfg.Irc.ImportMaxSize = 256 * 1024
+	}
+	if !md.IsDefined("Irc", "PluginHistory") {
+		cfg.Irc.PluginHistory = 5
+	}
+
+	// Default to a burst of 5 lines, then one line every 2 seconds
+	if cfg.Irc.FloodBurst <= 0 {
+		cfg.Irc.FloodBurst = 5
+	}
+	if !md.IsDefined("Irc", "FloodRate") {
+		cfg.Irc.FloodRate = 0.5
+	}
+
+	// Plugins get 5 seconds per call, and are disabled after 3 timeouts
+	if !md.IsDefined("Irc", "PluginTimeout") {
+		cfg.Irc.PluginTimeout = 5
+	}
+	if !md.IsDefined("Irc", "PluginMaxTimeouts") {
+		cfg.Irc.PluginMaxTimeouts = 3
+	}
+
+	// Without any [[Network]], the top level settings are the only network
+	if len(cfg.Network) == 0 {
+		cfg.networks = []*Settings{&cfg}
+	}
+	defined := networksDefined(md)
+	for i, network := range cfg.Network {
+		// Zero values mean the setting was left out when the keys don't
+		// match the networks, as with an inline array of networks
+		irc := reflect.ValueOf(network.Irc)
+		isDefined := func(field string) bool {
+			return !irc.FieldByName(field).IsZero()
+		}
+		if len(defined) == len(cfg.Network) {
+			keys := defined[i]
+			isDefined = func(field string) bool {
+				return keys[strings.ToLower(field)]
+			}
+		}
+		cfg.networks = append(cfg.networks, cfg.networkSettings(network, isDefined))
+	}
+	for _, network := range cfg.networks {
+		network.applyDefaults()
+	}
 
 	log.Println("Loaded config")
 
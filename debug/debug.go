@@ -2,6 +2,7 @@ package debug
 
 import (
 	"fmt"
+	"github.com/zenithar/aktarus/queue"
 	"github.com/zenithar/aktarus/state"
 	"html/template"
 	"log"
@@ -88,6 +89,8 @@ var indexTemplate string = `
 <html><head><title>Debug</title></head><body>
 <ul>
 	<li><a href="/debug/states">State tracking</a></li>
+	<li><a href="/debug/queue">Send queue</a></li>
+	<li><a href="/debug/plugins">Plugin queues</a></li>
 	<li><a href="/debug/memstats">Memstats</a></li>
 	<li><a href="/debug/pprof">Profiling</a></li>
 	<li><a href="/debug/stop">Stop debug server</a></li>
@@ -97,13 +100,14 @@ var indexTemplate string = `
 
 var stateTemplate string = `
 <html><head><title>State Debug</title></head><body>
-<h1>Channels</h1>
+{{range $network, $channels := .}}
+<h1>{{$network}} Channels</h1>
 <dl>
-	{{range $key, $val := .}}
+	{{range $key, $val := $channels}}
 		<dt><h2>{{$key}} Nicks</h2></dt>
 		{{range $nick, $priv := $val}}
 		<dd>
-			<strong>{{$nick}}</strong> - <em>
+			<strong>{{$priv.Name}}</strong> - <em>
 			{{if $priv.Owner}}Owner{{end}}
 			{{if $priv.Admin}}Admin{{end}}
 			{{if $priv.Op}}Op{{end}}
@@ -113,13 +117,78 @@ var stateTemplate string = `
 		{{end}}
 	{{end}}
 </dl>
+{{end}}
 </body></html>
 `
 
-var botState *state.StateTracker
+var queueTemplate string = `
+<html><head><title>Send Queue</title></head><body>
+{{range $network, $lanes := .}}
+<h1>{{$network}} Send Queue</h1>
+<dl>
+	{{range $lane, $depth := $lanes}}
+		<dt>{{$lane}}</dt>
+		<dd>{{$depth}} lines waiting</dd>
+	{{end}}
+</dl>
+{{end}}
+</body></html>
+`
 
-func SetState(s *state.StateTracker) {
-	botState = s
+var pluginQueueTemplate string = `
+<html><head><title>Plugin Queues</title></head><body>
+<h1>Plugin Queues</h1>
+<dl>
+	{{range $plugin, $depth := .}}
+		<dt>{{$plugin}}</dt>
+		<dd>{{$depth}} events waiting</dd>
+	{{end}}
+</dl>
+</body></html>
+`
+
+// Keyed by network name
+var botStates = make(map[string]*state.StateTracker)
+var sendQueues = make(map[string]*queue.Queue)
+
+func SetState(network string, s *state.StateTracker) {
+	botStates[network] = s
+}
+
+func SetQueue(network string, q *queue.Queue) {
+	sendQueues[network] = q
+}
+
+// Returns the number of events waiting for each plugin
+var pluginQueues func() map[string]int
+
+func SetPluginQueues(depths func() map[string]int) {
+	pluginQueues = depths
+}
+
+func printPluginQueues(w http.ResponseWriter, r *http.Request) {
+	if pluginQueues != nil {
+		tmpl, _ := template.New("plugins").Parse(pluginQueueTemplate)
+		// Error checking elided
+		tmpl.Execute(w, pluginQueues())
+	} else {
+		fmt.Fprint(w, "No plugin queues available")
+	}
+}
+
+func printQueue(w http.ResponseWriter, r *http.Request) {
+	if len(sendQueues) > 0 {
+		queueMapping := make(map[string]map[string]int)
+		for network, sendQueue := range sendQueues {
+			queueMapping[network] = sendQueue.Depths()
+		}
+
+		tmpl, _ := template.New("queue").Parse(queueTemplate)
+		// Error checking elided
+		tmpl.Execute(w, queueMapping)
+	} else {
+		fmt.Fprint(w, "No send queue available")
+	}
 }
 
 func printRuntimeInfo(w http.ResponseWriter, r *http.Request) {
@@ -131,13 +200,15 @@ func printRuntimeInfo(w http.ResponseWriter, r *http.Request) {
 }
 
 func printState(w http.ResponseWriter, r *http.Request) {
-	if botState != nil {
-		stateMapping := make(map[string]map[string]*state.ChannelPrivileges)
+	if len(botStates) > 0 {
+		stateMapping := make(map[string]map[string]map[string]state.MemberSnapshot)
 
-		for _, channel := range botState.Channels() {
-			c := botState.GetChannel(channel)
-			if c != nil {
-				stateMapping[channel] = c.Nicks
+		for network, botState := range botStates {
+			stateMapping[network] = make(map[string]map[string]state.MemberSnapshot)
+			for _, channel := range botState.Channels() {
+				if c, ok := botState.GetChannel(channel); ok {
+					stateMapping[network][c.Name] = c.Nicks
+				}
 			}
 		}
 
@@ -242,6 +313,8 @@ func StartDebugServer() (string, bool) {
 		http.HandleFunc("/debug/", printDebugIndex)
 		http.HandleFunc("/debug/memstats/", printRuntimeInfo)
 		http.HandleFunc("/debug/states/", printState)
+		http.HandleFunc("/debug/queue/", printQueue)
+		http.HandleFunc("/debug/plugins/", printPluginQueues)
 		http.HandleFunc("/debug/stop/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			StopDebugServer()
 		}))
@@ -1,14 +1,20 @@
 RegisterCommand("announce", function() {
-	var args = this.event.message.split(" "),
-		source = this.event.args[0],
-		cmd = args.shift(),
-		nick = this.event.nick,
-		cfg = GetConfig(),
-		privs = IRC.GetPrivs(source, nick);
+	var source = this.event.args[0],
+		channel = GetChannelConfig(source),
+		targets = GetChannels("announce");
 
-	if(privs && (privs.Owner || privs.Admin || privs.Op || privs.HalfOp) && source == cfg.Irc.StaffChannel) {
-		IRC.Privmsg(cfg.Irc.NormalChannel, "NOTICE: " + args.join(" "))
-	} else {
-		IRC.Action(source, "slaps "+nick+"'s hands away from the op only controls")
+	if(channel && channel.Role == "staff") {
+		// Without announce channels, announce in the normal ones
+		if(targets.length == 0) {
+			targets = GetChannels("normal")
+		}
+		for(var i = 0; i < targets.length; i++) {
+			IRC.Privmsg(targets[i], "NOTICE: " + this.args[0])
+		}
 	}
-}, "announces a message to the normal channel");
\ No newline at end of file
+}, {
+	help: "announces a message to the announce channels",
+	usage: "<message...>",
+	contexts: ["channel"],
+	permission: "announce"
+});
\ No newline at end of file
@@ -1,25 +1,17 @@
 RegisterCommand("hand", function() {
-	var args = this.event.message.split(" "),
-		target = this.event.args[0],
-		cmd = args.shift(),
-		nick = this.event.nick;
+	var target = this.target,
+		nick = this.event.nick,
+		what = this.args[0],
+		idx = what.indexOf(" to ");
 
-	if(args.length == 1) {
-		IRC.Action(target, "hands " + args[0] + " to " + nick)
-		return
-	} else if(args.length >= 2 && args[0] == "me") {
-		IRC.Action(target, "hands " + args[1] + " to " + nick)
-		return
-	} else if(args.length == 3 && args[1] == "to"){
-		IRC.Action(target, "hands " + args[0] + " to " + args[2] + ", courtesy of " + nick)
-		return
-	} else if(args.length > 3) {
-		var message = args.join(" ")
-		var idx = message.indexOf(" to ");
-		if(idx > -1) {
-			IRC.Action(target, "hands " + message.substring(0, idx) + message.substring(idx, message.length) + ", courtesy of " + nick)
-			return
-		}
+	if(what.indexOf("me ") == 0) {
+		IRC.Action(target, "hands " + what.substring(3) + " to " + nick)
+	} else if(idx > 0) {
+		IRC.Action(target, "hands " + what + ", courtesy of " + nick)
+	} else {
+		IRC.Action(target, "hands " + what + " to " + nick)
 	}
-	IRC.Privmsg(target, nick + ": usage - !hand [object] to [recipient] OR !hand me [object]")
-}, "!hand [object] to [recipient] or !hand me [object] to have the bot hand an item to someone")
\ No newline at end of file
+}, {
+	help: "hands you an object, or someone else one with <object> to <recipient>",
+	usage: "<object...>"
+});
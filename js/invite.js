@@ -1,14 +1,13 @@
 RegisterCommand("invite", function() {
-	var args = this.event.message.split(" "),
-		source = this.event.args[0],
-		cmd = args.shift(),
-		nick = this.event.nick,
-		cfg = GetConfig(),
-		privs = IRC.GetPrivs(source, nick);
+	var source = this.event.args[0],
+		channel = GetChannelConfig(source);
 
-	if(privs && (privs.Owner || privs.Admin || privs.Op) && source == cfg.Irc.StaffChannel) {
-		IRC.Invite(args[0], cfg.Irc.StaffChannel)
-	} else {
-		IRC.Action(source, "slaps "+nick+"'s hands away from the op only controls")
+	if(channel && channel.Role == "staff") {
+		IRC.Invite(this.args[0], source)
 	}
-}, "invites a user to the staff channel");
\ No newline at end of file
+}, {
+	help: "invites a user to the staff channel",
+	usage: "<nick>",
+	contexts: ["channel"],
+	permission: "invite"
+});
\ No newline at end of file
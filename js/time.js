@@ -1,6 +1,6 @@
 RegisterCommand("time", function(){
-	var source = this.event.args[0],
+	var target = this.target,
 		nick = this.event.nick,
 		date = new Date();
-	IRC.Privmsg(source, nick+": the time is " + date);
+	IRC.Privmsg(target, nick+": the time is " + date);
 }, "returns the current time for the bot");
\ No newline at end of file
@@ -1,6 +1,10 @@
+// @name url_titler
+// @description posts the title of links pasted in channels
+// @requires network
+
 RegisterCallback("PRIVMSG", "Url Titler", function() {
 	var url = UTILS.ExtractURL(this.event.message),
-		target = this.event.args[0],
+		target = this.target,
 		nick = this.event.nick,
 		me = IRC.GetNick();
 
@@ -1,13 +1,10 @@
 RegisterCommand("wiki", function(){
-	var args = this.event.message.split(" "),
-		source = this.event.args[0],
-		cmd = args.shift(),
+	var target = this.target,
 		nick = this.event.nick,
-		url = "http://www.wikipedia.org/wiki/" + encodeURIComponent(args.join("_"));
+		url = "http://www.wikipedia.org/wiki/" + encodeURIComponent(this.args[0].split(/\s+/).join("_"));
 
-	if(args.length > 0) {
-		IRC.Privmsg(source, nick+": Wikipedia - " + url);	
-	} else {
-		IRC.Privmsg(source, nick+": usage is - !wiki [query]");
-	}
-}, "returns an wikipedia page url for the given query");
+	IRC.Privmsg(target, nick+": Wikipedia - " + url);
+}, {
+	help: "returns an wikipedia page url for the given query",
+	usage: "<query...>"
+});
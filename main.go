@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
@@ -8,37 +9,92 @@ import (
 
 	"github.com/zenithar/aktarus/bot"
 	"github.com/zenithar/aktarus/config"
+	"github.com/zenithar/aktarus/plugins"
+	"github.com/zenithar/aktarus/store"
 )
 
 func main() {
+	// Backups of the plugin store
+	exportStore := flag.String("export-store", "", "writes the plugin store as JSON to the given file and exits")
+	importStore := flag.String("import-store", "", "loads a JSON export into the plugin store and exits")
 
 	// Load config
 	cfg := config.Load()
 
-	// Set up Irc Client
-	client, err := bot.New(cfg)
-
-	err = client.Connect()
-
+	// Open the plugin store
+	st, err := store.Open(cfg.Irc.StorePath)
 	if err != nil {
 		fmt.Printf("Error: %s\n", err)
 		return
 	}
+	defer st.Close()
+
+	switch {
+	case *exportStore != "":
+		if err := exportTo(st, *exportStore); err != nil {
+			fmt.Printf("Error: %s\n", err)
+		}
+		return
+	case *importStore != "":
+		if err := importFrom(st, *importStore); err != nil {
+			fmt.Printf("Error: %s\n", err)
+		}
+		return
+	}
+
+	// Plugins are shared by every network
+	pm := plugins.New(cfg, st)
+
+	// Set up an Irc Client per network
+	clients := make([]*bot.Bot, 0, len(cfg.Networks()))
+	for _, network := range cfg.Networks() {
+		client, err := bot.New(network, pm)
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			return
+		}
+		clients = append(clients, client)
+	}
+
+	// Boot up the plugin js environment
+	pm.InitJS()
+	if cfg.Irc.WatchPlugins {
+		pm.WatchPlugins()
+	}
+
+	for _, client := range clients {
+		if err := client.Connect(); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			return
+		}
+	}
 
 	trap := make(chan os.Signal, 1)
 	quit := make(chan bool)
+	quitted := make(chan bool)
 
 	signal.Notify(trap, os.Interrupt, syscall.SIGTERM)
 
+	for _, client := range clients {
+		go func(client *bot.Bot) {
+			<-client.Quitted
+			quitted <- true
+		}(client)
+	}
+
 	go func() {
-		select {
-		case sig := <-trap:
-			fmt.Printf("Caught: %s - quitting\n", sig)
-			quit <- true
-		case <-client.Quitted:
-			fmt.Println("Client quitted out\n")
-			quit <- true
+		// Keep running until every client quit
+		for running := len(clients); running > 0; {
+			select {
+			case sig := <-trap:
+				fmt.Printf("Caught: %s - quitting\n", sig)
+				running = 0
+			case <-quitted:
+				fmt.Println("Client quitted out")
+				running--
+			}
 		}
+		quit <- true
 		signal.Stop(trap)
 	}()
 
@@ -46,5 +102,31 @@ func main() {
 	<-quit
 
 	fmt.Println("Quitting...")
+
+	// Save what plugins stored last, os.Exit skipping deferred calls
+	st.Close()
 	os.Exit(0)
 }
+
+// Writes the store to a JSON file
+func exportTo(st *store.Store, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err = st.Export(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Loads a JSON file into the store
+func importFrom(st *store.Store, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return st.Import(file)
+}
@@ -0,0 +1,178 @@
+package permissions
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/zenithar/aktarus/config"
+	"github.com/zenithar/aktarus/queue"
+	"github.com/zenithar/aktarus/state"
+	"github.com/zenithar/aktarus/utils"
+)
+
+// Channel status levels, from lowest to highest
+var statusLevels = map[string]int{
+	"voice":  1,
+	"halfop": 2,
+	"op":     3,
+	"admin":  4,
+	"owner":  5,
+}
+
+// Roles used when none are configured, matching the old op only checks
+var defaultRoles = []config.RoleSettings{
+	{Name: "owner", Status: "owner", Permissions: []string{"*"}},
+	{Name: "op", Status: "op", Permissions: []string{"reload", "plugin", "quit", "voice", "op", "ban", "debug", "invite", "announce"}},
+	{Name: "halfop", Status: "halfop", Permissions: []string{"announce"}},
+}
+
+type Manager struct {
+	roles []config.RoleSettings
+	state *state.StateTracker
+	log   *log.Logger
+}
+
+func New(cfg *config.Settings, state *state.StateTracker) *Manager {
+	roles := cfg.Role
+	if len(roles) == 0 {
+		roles = defaultRoles
+	}
+
+	m := &Manager{
+		roles: roles,
+		state: state,
+		log:   log.New(os.Stdout, "[permissions] ", log.LstdFlags),
+	}
+	for _, role := range roles {
+		if _, ok := statusLevels[strings.ToLower(role.Status)]; role.Status != "" && !ok {
+			m.log.Printf("Role `%s` has unknown channel status `%s`, ignoring it\n", role.Name, role.Status)
+		}
+	}
+	return m
+}
+
+// Returns the names of the roles held by source (nick!user@host) when
+// issuing a command in channel
+func (m *Manager) Roles(channel, source string) []string {
+	roles := make([]string, 0)
+	for i := range m.roles {
+		if m.matches(&m.roles[i], channel, source) {
+			roles = append(roles, m.roles[i].Name)
+		}
+	}
+	return roles
+}
+
+// Whether source (nick!user@host) holds a role granting the permission
+// in channel
+func (m *Manager) Can(channel, source, permission string) bool {
+	for i := range m.roles {
+		role := &m.roles[i]
+		if grants(role, permission) && m.matches(role, channel, source) {
+			return true
+		}
+	}
+	return false
+}
+
+// Tells nick they aren't allowed to do that
+func (m *Manager) Deny(q *queue.Queue, target, nick string) {
+	utils.IRCAction(q, target, fmt.Sprintf("slaps %s's hands away from the restricted controls", nick))
+}
+
+// Whether the role grants the permission
+func grants(role *config.RoleSettings, permission string) bool {
+	for _, p := range role.Permissions {
+		if p == "*" || strings.EqualFold(p, permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether source matches any of the role's accounts, hostmasks or channel
+// status
+func (m *Manager) matches(role *config.RoleSettings, channel, source string) bool {
+	nick := source
+	if idx := strings.Index(source, "!"); idx != -1 {
+		nick = source[:idx]
+	}
+
+	if len(role.Accounts) > 0 {
+		if info, ok := m.state.GetNick(nick); ok && info.Account != "" {
+			for _, account := range role.Accounts {
+				if m.state.EqualFold(account, info.Account) {
+					return true
+				}
+			}
+		}
+	}
+
+	if len(role.Hostmasks) > 0 {
+		casemapping := m.state.ServerInfo().CaseMapping
+		for _, mask := range role.Hostmasks {
+			if MatchMask(state.FoldCase(casemapping, mask), state.FoldCase(casemapping, source)) {
+				return true
+			}
+		}
+	}
+
+	if required, ok := statusLevels[strings.ToLower(role.Status)]; ok {
+		channels := role.Channels
+		if len(channels) == 0 {
+			channels = []string{channel}
+		}
+		for _, c := range channels {
+			if privs, ok := m.state.GetPrivs(c, nick); ok && statusLevel(privs) >= required {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Returns the highest status level held
+func statusLevel(privs state.ChannelPrivileges) int {
+	switch {
+	case privs.Owner:
+		return statusLevels["owner"]
+	case privs.Admin:
+		return statusLevels["admin"]
+	case privs.Op:
+		return statusLevels["op"]
+	case privs.HalfOp:
+		return statusLevels["halfop"]
+	case privs.Voice:
+		return statusLevels["voice"]
+	}
+	return 0
+}
+
+// Matches a string against a mask using * and ? wildcards
+func MatchMask(mask, s string) bool {
+	star, next := -1, 0
+	i, j := 0, 0
+	for j < len(s) {
+		switch {
+		case i < len(mask) && mask[i] == '*':
+			star, next = i, j
+			i++
+		case i < len(mask) && (mask[i] == '?' || mask[i] == s[j]):
+			i++
+			j++
+		case star != -1:
+			// Let the last * swallow one more character
+			next++
+			i, j = star+1, next
+		default:
+			return false
+		}
+	}
+	for i < len(mask) && mask[i] == '*' {
+		i++
+	}
+	return i == len(mask)
+}
@@ -0,0 +1,266 @@
+package plugins
+
+import (
+	"fmt"
+	"github.com/robertkrimen/otto"
+	"github.com/zenithar/aktarus/utils"
+	"strings"
+	"time"
+)
+
+// Options a command is registered with, either just its help or an
+// object like:
+//
+//	{
+//		help: "kicks a nick",
+//		aliases: ["k"],
+//		usage: "<nick> [reason...]",
+//		cooldown: {user: 30, channel: 5},
+//		contexts: ["channel", "pm", "#staff"],
+//		permission: "kick"
+//	}
+//
+// minArgs and maxArgs default to what usage says, a trailing ... argument
+// taking the rest of the message.
+type commandOptions struct {
+	name       string
+	help       string
+	aliases    []string
+	usage      string
+	permission string
+
+	// Arguments accepted, maxArgs being -1 when there is no limit, and
+	// the number of arguments in usage, the last one taking the rest of
+	// the message when variadic
+	minArgs, maxArgs int
+	params           int
+	variadic         bool
+
+	// Time between uses, per nick and per channel, and when the command
+	// was last used. Only used from the plugin's worker
+	userCooldown, channelCooldown time.Duration
+	usedBy, usedIn                map[string]time.Time
+
+	// Where the command may be used: channel, pm or channel names, anywhere
+	// when empty
+	contexts []string
+}
+
+// Returns the options for a command registered with just its help
+func newCommandOptions(name, help string) *commandOptions {
+	return &commandOptions{
+		name:    name,
+		help:    help,
+		maxArgs: -1,
+		usedBy:  make(map[string]time.Time),
+		usedIn:  make(map[string]time.Time),
+	}
+}
+
+// Reads the options set in a JS object
+func (o *commandOptions) parse(obj *otto.Object) error {
+	str := func(key string) (string, error) {
+		val, err := obj.Get(key)
+		if err != nil || val.IsUndefined() {
+			return "", err
+		}
+		if !val.IsString() {
+			return "", fmt.Errorf("option `%s` should be a string", key)
+		}
+		return val.String(), nil
+	}
+	strs := func(key string) ([]string, error) {
+		val, err := obj.Get(key)
+		if err != nil || val.IsUndefined() {
+			return nil, err
+		}
+		list, ok := utils.JavascriptArrayToSlice(val)
+		if !ok {
+			return nil, fmt.Errorf("option `%s` should be an array of strings", key)
+		}
+		return list, nil
+	}
+	num := func(obj *otto.Object, key string, set func(float64)) error {
+		val, err := obj.Get(key)
+		if err != nil || val.IsUndefined() {
+			return err
+		}
+		n, err := val.ToFloat()
+		if !val.IsNumber() || err != nil || n < 0 {
+			return fmt.Errorf("option `%s` should be a positive number", key)
+		}
+		set(n)
+		return nil
+	}
+
+	var err error
+	if o.help, err = str("help"); err != nil {
+		return err
+	}
+	if o.permission, err = str("permission"); err != nil {
+		return err
+	}
+	if o.aliases, err = strs("aliases"); err != nil {
+		return err
+	}
+	if o.contexts, err = strs("contexts"); err != nil {
+		return err
+	}
+	if o.usage, err = str("usage"); err != nil {
+		return err
+	}
+	o.parseUsage()
+
+	if err = num(obj, "minArgs", func(n float64) { o.minArgs = int(n) }); err != nil {
+		return err
+	}
+	if err = num(obj, "maxArgs", func(n float64) { o.maxArgs = int(n) }); err != nil {
+		return err
+	}
+	if o.maxArgs >= 0 && o.maxArgs < o.minArgs {
+		return fmt.Errorf("maxArgs is lower than minArgs")
+	}
+
+	if val, err := obj.Get("cooldown"); err != nil {
+		return err
+	} else if val.IsObject() {
+		cooldown := val.Object()
+		if err = num(cooldown, "user", func(n float64) { o.userCooldown = time.Duration(n * float64(time.Second)) }); err != nil {
+			return err
+		}
+		if err = num(cooldown, "channel", func(n float64) { o.channelCooldown = time.Duration(n * float64(time.Second)) }); err != nil {
+			return err
+		}
+	} else if val.IsDefined() {
+		return fmt.Errorf("option `cooldown` should be an object like {user: 30, channel: 5}")
+	}
+	return nil
+}
+
+// Sets the number of arguments from usage, where <arg> is required, [arg]
+// optional and a last arg... takes the rest of the message
+func (o *commandOptions) parseUsage() {
+	params := strings.Fields(o.usage)
+	o.params = len(params)
+	o.minArgs, o.maxArgs, o.variadic = 0, len(params), false
+	for i, param := range params {
+		if !strings.HasPrefix(param, "[") {
+			o.minArgs = i + 1
+		}
+		if i == len(params)-1 && strings.HasSuffix(strings.TrimRight(param, ">]"), "...") {
+			o.maxArgs, o.variadic = -1, true
+		}
+	}
+	if o.usage == "" {
+		o.maxArgs = -1
+	}
+}
+
+// Splits the text following the command into its arguments, the last one
+// taking the rest of the text when usage ends with a variadic argument
+func (o *commandOptions) parseArgs(text string) []string {
+	args := make([]string, 0)
+	rest := strings.TrimSpace(text)
+	for rest != "" {
+		if o.variadic && len(args) == o.params-1 {
+			return append(args, rest)
+		}
+		idx := strings.IndexAny(rest, " \t")
+		if idx == -1 {
+			return append(args, rest)
+		}
+		args = append(args, rest[:idx])
+		rest = strings.TrimLeft(rest[idx:], " \t")
+	}
+	return args
+}
+
+// Whether the command takes that many arguments
+func (o *commandOptions) validArgs(count int) bool {
+	return count >= o.minArgs && (o.maxArgs < 0 || count <= o.maxArgs)
+}
+
+// Returns how the command is called, for replies to bad arguments, the
+// command being shown with prefix
+func (o *commandOptions) usageMessage(prefix string) string {
+	switch {
+	case o.usage != "":
+		return fmt.Sprintf("usage is %s%s %s", prefix, o.name, o.usage)
+	case o.maxArgs < 0:
+		return fmt.Sprintf("%s%s takes at least %d arguments", prefix, o.name, o.minArgs)
+	case o.minArgs == o.maxArgs:
+		return fmt.Sprintf("%s%s takes %d arguments", prefix, o.name, o.minArgs)
+	default:
+		return fmt.Sprintf("%s%s takes %d to %d arguments", prefix, o.name, o.minArgs, o.maxArgs)
+	}
+}
+
+// Returns the help shown by help, with the usage and aliases
+func (o *commandOptions) helpMessage(prefix string) string {
+	help := o.help
+	if o.usage != "" {
+		help = fmt.Sprintf("call like %s%s %s, %s", prefix, o.name, o.usage, help)
+	}
+	if len(o.aliases) > 0 {
+		help += fmt.Sprintf(" (also %s%s)", prefix, strings.Join(o.aliases, ", "+prefix))
+	}
+	return help
+}
+
+// Whether the command may be used in target, a channel or the bot's nick
+func (o *commandOptions) allowedIn(network *Network, target string) bool {
+	if len(o.contexts) == 0 {
+		return true
+	}
+	isChannel := network.state.ServerInfo().IsChannel(target)
+	for _, context := range o.contexts {
+		switch {
+		case context == "channel" && isChannel:
+			return true
+		case context == "pm" && !isChannel:
+			return true
+		case isChannel && network.state.EqualFold(context, target):
+			return true
+		}
+	}
+	return false
+}
+
+// Returns how long until nick may use the command again in target,
+// recording the use when it may be used right away
+func (o *commandOptions) cooldown(network *Network, nick, target string) time.Duration {
+	now := time.Now()
+	user := network.Name + " " + network.state.FoldCase(nick)
+	channel := network.Name + " " + network.state.FoldCase(target)
+
+	var left time.Duration
+	if next := o.usedBy[user].Add(o.userCooldown); o.userCooldown > 0 && next.After(now) {
+		left = next.Sub(now)
+	}
+	if next := o.usedIn[channel].Add(o.channelCooldown); o.channelCooldown > 0 && next.After(now) && next.Sub(now) > left {
+		left = next.Sub(now)
+	}
+	if left > 0 {
+		return left
+	}
+
+	// Forget the uses that no longer matter
+	for key, used := range o.usedBy {
+		if now.Sub(used) > o.userCooldown {
+			delete(o.usedBy, key)
+		}
+	}
+	for key, used := range o.usedIn {
+		if now.Sub(used) > o.channelCooldown {
+			delete(o.usedIn, key)
+		}
+	}
+
+	if o.userCooldown > 0 {
+		o.usedBy[user] = now
+	}
+	if o.channelCooldown > 0 && network.state.ServerInfo().IsChannel(target) {
+		o.usedIn[channel] = now
+	}
+	return 0
+}
@@ -2,15 +2,51 @@ package plugins
 
 import (
 	"github.com/robertkrimen/otto"
+	"github.com/zenithar/aktarus/utils"
 )
 
-func (pm *PluginManager) InitConfigJSBridge() {
-	pm.js.Set("GetConfig", func(call otto.FunctionCall) otto.Value {
-		if len(call.ArgumentList) == 0 {
-			if val, err := pm.js.ToValue(pm.cfg); err == nil {
-				return val
+// Sets up GetConfig, which exposes passwords and so needs the config
+// capability, GetChannelConfig and GetChannels
+func (pm *PluginManager) InitConfigJSBridge(p *Plugin, network func() *Network) {
+	js := p.js
+	if p.granted(CapConfig) {
+		js.Set("GetConfig", func(call otto.FunctionCall) otto.Value {
+			if len(call.ArgumentList) == 0 {
+				if val, err := js.ToValue(network().cfg); err == nil {
+					return val
+				}
+			}
+			return otto.FalseValue()
+		})
+	}
+
+	// Settings of a configured channel, false for other channels. Channel
+	// keys are left out without the config capability.
+	js.Set("GetChannelConfig", func(call otto.FunctionCall) otto.Value {
+		if len(call.ArgumentList) == 1 && call.ArgumentList[0].IsString() {
+			if settings, ok := network().state.ChannelConfig(call.Argument(0).String()); ok {
+				if !p.granted(CapConfig) {
+					settings.Key = ""
+				}
+				if val, err := js.ToValue(settings); err == nil {
+					return val
+				}
 			}
 		}
 		return otto.FalseValue()
 	})
+
+	// Names of the configured channels, only those with the role if given
+	js.Set("GetChannels", func(call otto.FunctionCall) otto.Value {
+		if len(call.ArgumentList) > 1 || (len(call.ArgumentList) == 1 && !call.ArgumentList[0].IsString()) {
+			return otto.FalseValue()
+		}
+		channels := make([]string, 0)
+		for _, channel := range network().cfg.Channel {
+			if len(call.ArgumentList) == 0 || channel.Role == call.Argument(0).String() {
+				channels = append(channels, channel.Name)
+			}
+		}
+		return utils.SliceToJavascriptArray(js, channels)
+	})
 }
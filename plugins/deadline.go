@@ -0,0 +1,65 @@
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"github.com/robertkrimen/otto"
+	"time"
+)
+
+// How long interrupted JS gets to unwind before we stop waiting for it
+const interruptGrace = time.Second
+
+var errTimeout = errors.New("execution time limit exceeded")
+
+// Panic value used to unwind interrupted JS
+type timeoutPanic struct{}
+
+// Runs fn against the VM in its own goroutine, interrupting the JS once it
+// runs for longer than timeout (0 for no limit). JS blocked in a Go
+// function, like a slow UTILS.GetPage, only notices the interrupt once that
+// returns, so it is left behind after a grace period. idle is called
+// whenever fn really returns.
+func runWithDeadline(js *otto.Otto, timeout time.Duration, fn func() error, idle func()) error {
+	// Drop an interrupt meant for a run that finished just in time
+	select {
+	case <-js.Interrupt:
+	default:
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer idle()
+		defer func() {
+			if r := recover(); r != nil {
+				if _, ok := r.(timeoutPanic); ok {
+					done <- errTimeout
+				} else {
+					done <- fmt.Errorf("panicked: %v", r)
+				}
+			}
+		}()
+		done <- fn()
+	}()
+
+	if timeout <= 0 {
+		return <-done
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+	}
+
+	js.Interrupt <- func() {
+		panic(timeoutPanic{})
+	}
+	select {
+	case <-done:
+	case <-time.After(interruptGrace):
+	}
+	return errTimeout
+}
@@ -9,7 +9,7 @@ type pmDebugJSBridge struct {
 	StackTrace func(call otto.FunctionCall) otto.Value
 }
 
-func (pm *PluginManager) InitDebugJSBridge() {
+func (pm *PluginManager) InitDebugJSBridge(js *otto.Otto) {
 	bridge := &pmDebugJSBridge{
 		StackTrace: func(call otto.FunctionCall) otto.Value {
 			if len(call.ArgumentList) == 0 {
@@ -19,5 +19,5 @@ func (pm *PluginManager) InitDebugJSBridge() {
 			return otto.FalseValue()
 		},
 	}
-	pm.js.Set("DEBUG", bridge)
+	js.Set("DEBUG", bridge)
 }
@@ -0,0 +1,151 @@
+package plugins
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Writes data to a hidden temporary file next to path, then moves it over
+// path, so neither the plugin loader nor the watcher see it half written
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Returns the directory, hidden from the plugin loader, keeping the
+// versions of a plugin replaced by !import
+func (pm *PluginManager) historyDir(name string) string {
+	return filepath.Join(pm.cfg.Irc.PluginsDir, ".history", strings.TrimSuffix(name, ".js"))
+}
+
+// Returns the files of the archived versions of a plugin, oldest first
+func (pm *PluginManager) history(name string) ([]string, error) {
+	dir := pm.historyDir(name)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	versions := make([]string, 0, len(files))
+	for _, file := range files {
+		if file.Mode().IsRegular() && !filepath.HasPrefix(file.Name(), ".") {
+			versions = append(versions, filepath.Join(dir, file.Name()))
+		}
+	}
+	sort.Strings(versions)
+	return versions, nil
+}
+
+// Archives a version of a plugin, dropping the oldest versions beyond
+// PluginHistory
+func (pm *PluginManager) archivePlugin(name string, code []byte) error {
+	dir := pm.historyDir(name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	version := time.Now().UTC().Format("20060102T150405.000000000") + ".js"
+	if err := writeFileAtomic(filepath.Join(dir, version), code); err != nil {
+		return err
+	}
+
+	versions, err := pm.history(name)
+	if err != nil {
+		return err
+	}
+	for len(versions) > pm.cfg.Irc.PluginHistory {
+		if err := os.Remove(versions[0]); err != nil {
+			return err
+		}
+		versions = versions[1:]
+	}
+	return nil
+}
+
+// Writes a new version of a plugin and loads it, putting previous back,
+// or removing the file when there was none, if the new one fails to run.
+// Must be called with the lock held.
+func (pm *PluginManager) installPlugin(path string, code, previous []byte) error {
+	if err := writeFileAtomic(path, code); err != nil {
+		return err
+	}
+
+	err := pm.loadPlugin(path)
+	if err == nil {
+		return nil
+	}
+
+	var restoreErr error
+	if previous == nil {
+		restoreErr = os.Remove(path)
+	} else {
+		restoreErr = writeFileAtomic(path, previous)
+	}
+	if restoreErr != nil {
+		pm.log.Printf("Couldn't restore the previous version of `%s`: %s\n", path, restoreErr)
+	}
+	return err
+}
+
+// Puts back the latest version of a plugin archived by !import, dropping
+// it from the history
+func (pm *PluginManager) RollbackPlugin(name string) error {
+	name, err := pluginName(name)
+	if err != nil {
+		return err
+	}
+
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	versions, err := pm.history(name)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return fmt.Errorf("Plugin `%s` has no previous version", name)
+	}
+	latest := versions[len(versions)-1]
+	code, err := ioutil.ReadFile(latest)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(pm.cfg.Irc.PluginsDir, name)
+	if plugin, ok := pm.plugins[name]; ok {
+		path = plugin.path
+	}
+	current, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := pm.installPlugin(path, code, current); err != nil {
+		return err
+	}
+	return os.Remove(latest)
+}
@@ -8,26 +8,48 @@ import (
 
 type pmIRCJSBridge struct {
 	Nick, GetNick, SendRaw, Privmsg, Notice, Action,
-	Part, Join, Who, Whois, Mode, Nicks, Channels,
-	Topic, Away, Invite, Oper, GetPrivs, Redispatch func(call otto.FunctionCall) otto.Value
+	Part, Join, Who, Whois, Mode, SetModes, Nicks, Channels,
+	Topic, Away, Invite, Oper, GetPrivs, GetNickInfo, GetModeList, HasCap, HasPermission, Redispatch,
+	GetNetwork, Networks, Network func(call otto.FunctionCall) otto.Value
 }
 
-func stateNickToValue(nick *state.Nick) (val otto.Value) {
-	return
+func stateNickToValue(js *otto.Otto, nick state.NickSnapshot) otto.Value {
+	obj, _ := js.Object("({})")
+	obj.Set("Nick", nick.Nick)
+	obj.Set("User", nick.User)
+	obj.Set("Host", nick.Host)
+	obj.Set("Name", nick.Name)
+	obj.Set("Account", nick.Account)
+	obj.Set("Away", nick.Away)
+	obj.Set("AwayMessage", nick.AwayMessage)
+	obj.Set("Modes", nick.Modes)
+	channels, _ := js.Object("({})")
+	for _, privs := range nick.Channels {
+		channels.Set(privs.Name, privs.ChannelPrivileges)
+	}
+	obj.Set("Channels", channels)
+	return obj.Value()
+}
+
+func (pm *PluginManager) InitIRCJSBridge(p *Plugin, network func() *Network) {
+	p.js.Set("IRC", pm.newIRCJSBridge(p, network))
 }
 
-func (pm *PluginManager) InitIRCJSBridge() {
+// Returns the IRC bridge for the network returned by network, with the
+// functions the plugin wasn't granted left out
+func (pm *PluginManager) newIRCJSBridge(p *Plugin, network func() *Network) *pmIRCJSBridge {
+	js := p.js
 	bridge := &pmIRCJSBridge{
 		Nick: func(call otto.FunctionCall) otto.Value {
 			if len(call.ArgumentList) == 1 && call.ArgumentList[0].IsString() {
-				pm.conn.Nick(call.Argument(0).String())
+				network().queue.Nick(call.Argument(0).String())
 				return otto.TrueValue()
 			} else {
 				return otto.FalseValue()
 			}
 		},
 		GetNick: func(call otto.FunctionCall) otto.Value {
-			val, err := otto.ToValue(pm.conn.GetNick())
+			val, err := otto.ToValue(network().conn.GetNick())
 			if err != nil {
 				return otto.NullValue()
 			}
@@ -35,7 +57,7 @@ func (pm *PluginManager) InitIRCJSBridge() {
 		},
 		SendRaw: func(call otto.FunctionCall) otto.Value {
 			if len(call.ArgumentList) == 1 && call.ArgumentList[0].IsString() {
-				pm.conn.SendRaw(call.Argument(0).String())
+				network().queue.SendRaw(call.Argument(0).String())
 				return otto.TrueValue()
 			} else {
 				return otto.FalseValue()
@@ -43,7 +65,7 @@ func (pm *PluginManager) InitIRCJSBridge() {
 		},
 		Privmsg: func(call otto.FunctionCall) otto.Value {
 			if len(call.ArgumentList) == 2 && call.ArgumentList[0].IsString() && call.ArgumentList[1].IsString() {
-				pm.conn.Privmsg(call.Argument(0).String(), call.Argument(1).String())
+				network().queue.Privmsg(call.Argument(0).String(), call.Argument(1).String())
 				return otto.TrueValue()
 			} else {
 				return otto.FalseValue()
@@ -51,7 +73,7 @@ func (pm *PluginManager) InitIRCJSBridge() {
 		},
 		Notice: func(call otto.FunctionCall) otto.Value {
 			if len(call.ArgumentList) == 2 && call.ArgumentList[0].IsString() && call.ArgumentList[1].IsString() {
-				pm.conn.Notice(call.Argument(0).String(), call.Argument(1).String())
+				network().queue.Notice(call.Argument(0).String(), call.Argument(1).String())
 				return otto.TrueValue()
 			} else {
 				return otto.FalseValue()
@@ -59,7 +81,7 @@ func (pm *PluginManager) InitIRCJSBridge() {
 		},
 		Part: func(call otto.FunctionCall) otto.Value {
 			if len(call.ArgumentList) == 1 && call.ArgumentList[0].IsString() {
-				pm.conn.Part(call.Argument(0).String())
+				network().queue.Part(call.Argument(0).String())
 				return otto.TrueValue()
 			} else {
 				return otto.FalseValue()
@@ -67,7 +89,7 @@ func (pm *PluginManager) InitIRCJSBridge() {
 		},
 		Join: func(call otto.FunctionCall) otto.Value {
 			if len(call.ArgumentList) == 1 && call.ArgumentList[0].IsString() {
-				pm.conn.Join(call.Argument(0).String())
+				network().queue.Join(call.Argument(0).String())
 				return otto.TrueValue()
 			} else {
 				return otto.FalseValue()
@@ -75,7 +97,7 @@ func (pm *PluginManager) InitIRCJSBridge() {
 		},
 		Who: func(call otto.FunctionCall) otto.Value {
 			if len(call.ArgumentList) == 1 && call.ArgumentList[0].IsString() {
-				pm.conn.Who(call.Argument(0).String())
+				network().queue.Who(call.Argument(0).String())
 				return otto.TrueValue()
 			} else {
 				return otto.FalseValue()
@@ -83,7 +105,7 @@ func (pm *PluginManager) InitIRCJSBridge() {
 		},
 		Whois: func(call otto.FunctionCall) otto.Value {
 			if len(call.ArgumentList) == 1 && call.ArgumentList[0].IsString() {
-				pm.conn.Whois(call.Argument(0).String())
+				network().queue.Whois(call.Argument(0).String())
 				return otto.TrueValue()
 			} else {
 				return otto.FalseValue()
@@ -91,7 +113,7 @@ func (pm *PluginManager) InitIRCJSBridge() {
 		},
 		Mode: func(call otto.FunctionCall) otto.Value {
 			if len(call.ArgumentList) == 1 && call.ArgumentList[0].IsString() {
-				pm.conn.Mode(call.Argument(0).String())
+				network().queue.Mode(call.Argument(0).String())
 				return otto.TrueValue()
 			} else {
 				if len(call.ArgumentList) > 1 && call.ArgumentList[0].IsString() {
@@ -102,20 +124,41 @@ func (pm *PluginManager) InitIRCJSBridge() {
 						}
 						args = append(args, arg.String())
 					}
-					pm.conn.Mode(call.Argument(0).String(), args...)
+					network().queue.Mode(call.Argument(0).String(), args...)
+					return otto.TrueValue()
 				}
 				return otto.FalseValue()
 			}
 		},
+		SetModes: func(call otto.FunctionCall) otto.Value {
+			if len(call.ArgumentList) == 2 && call.ArgumentList[0].IsString() && call.ArgumentList[1].IsObject() {
+				items, ok := utils.JavascriptArrayToSlice(call.Argument(1))
+				if !ok {
+					return otto.FalseValue()
+				}
+				changes := make([]state.ModeChange, 0, len(items))
+				for _, item := range items {
+					change, ok := state.ParseModeChange(item)
+					if !ok {
+						return otto.FalseValue()
+					}
+					changes = append(changes, change)
+				}
+				if val, err := otto.ToValue(network().state.SetModes(call.Argument(0).String(), changes...)); err == nil {
+					return val
+				}
+			}
+			return otto.FalseValue()
+		},
 		Nicks: func(call otto.FunctionCall) otto.Value {
-			return utils.SliceToJavascriptArray(pm.js, pm.state.Nicks())
+			return utils.SliceToJavascriptArray(js, network().state.Nicks())
 		},
 		Channels: func(call otto.FunctionCall) otto.Value {
-			return utils.SliceToJavascriptArray(pm.js, pm.state.Channels())
+			return utils.SliceToJavascriptArray(js, network().state.Channels())
 		},
 		Action: func(call otto.FunctionCall) otto.Value {
 			if len(call.ArgumentList) == 2 && call.ArgumentList[0].IsString() && call.ArgumentList[1].IsString() {
-				utils.IRCAction(pm.conn, call.Argument(0).String(), call.Argument(1).String())
+				utils.IRCAction(network().queue, call.Argument(0).String(), call.Argument(1).String())
 				return otto.TrueValue()
 			} else {
 				return otto.FalseValue()
@@ -124,10 +167,10 @@ func (pm *PluginManager) InitIRCJSBridge() {
 		Topic: func(call otto.FunctionCall) otto.Value {
 			switch {
 			case len(call.ArgumentList) == 1 && call.ArgumentList[0].IsString():
-				utils.IRCTopic(pm.conn, call.Argument(0).String())
+				utils.IRCTopic(network().queue, call.Argument(0).String())
 				return otto.TrueValue()
 			case len(call.ArgumentList) == 2 && call.ArgumentList[0].IsString() && call.ArgumentList[1].IsString():
-				utils.IRCTopic(pm.conn, call.Argument(0).String(), call.Argument(1).String())
+				utils.IRCTopic(network().queue, call.Argument(0).String(), call.Argument(1).String())
 				return otto.TrueValue()
 			default:
 				return otto.FalseValue()
@@ -136,10 +179,10 @@ func (pm *PluginManager) InitIRCJSBridge() {
 		Away: func(call otto.FunctionCall) otto.Value {
 			switch {
 			case len(call.ArgumentList) == 0:
-				utils.IRCAway(pm.conn)
+				utils.IRCAway(network().queue)
 				return otto.TrueValue()
 			case len(call.ArgumentList) == 1 && call.ArgumentList[0].IsString():
-				utils.IRCAway(pm.conn, call.Argument(0).String())
+				utils.IRCAway(network().queue, call.Argument(0).String())
 				return otto.TrueValue()
 			default:
 				return otto.FalseValue()
@@ -147,7 +190,7 @@ func (pm *PluginManager) InitIRCJSBridge() {
 		},
 		Oper: func(call otto.FunctionCall) otto.Value {
 			if len(call.ArgumentList) == 2 && call.ArgumentList[0].IsString() && call.ArgumentList[1].IsString() {
-				utils.IRCOper(pm.conn, call.Argument(0).String(), call.Argument(1).String())
+				utils.IRCOper(network().queue, call.Argument(0).String(), call.Argument(1).String())
 				return otto.TrueValue()
 			} else {
 				return otto.FalseValue()
@@ -155,7 +198,7 @@ func (pm *PluginManager) InitIRCJSBridge() {
 		},
 		Invite: func(call otto.FunctionCall) otto.Value {
 			if len(call.ArgumentList) == 2 && call.ArgumentList[0].IsString() && call.ArgumentList[1].IsString() {
-				utils.IRCInvite(pm.conn, call.Argument(0).String(), call.Argument(1).String())
+				utils.IRCInvite(network().queue, call.Argument(0).String(), call.Argument(1).String())
 				return otto.TrueValue()
 			} else {
 				return otto.FalseValue()
@@ -163,14 +206,58 @@ func (pm *PluginManager) InitIRCJSBridge() {
 		},
 		GetPrivs: func(call otto.FunctionCall) otto.Value {
 			if len(call.ArgumentList) == 2 && call.ArgumentList[0].IsString() && call.ArgumentList[1].IsString() {
-				if privs, ok := pm.state.GetPrivs(call.Argument(0).String(), call.Argument(1).String()); ok {
-					if val, err := pm.js.ToValue(privs); err == nil {
+				if privs, ok := network().state.GetPrivs(call.Argument(0).String(), call.Argument(1).String()); ok {
+					if val, err := js.ToValue(privs); err == nil {
 						return val
 					}
 				}
 			}
 			return otto.FalseValue()
 		},
+		GetNickInfo: func(call otto.FunctionCall) otto.Value {
+			if len(call.ArgumentList) == 1 && call.ArgumentList[0].IsString() {
+				if nick, ok := network().state.GetNick(call.Argument(0).String()); ok {
+					return stateNickToValue(js, nick)
+				}
+			}
+			return otto.FalseValue()
+		},
+		GetModeList: func(call otto.FunctionCall) otto.Value {
+			if len(call.ArgumentList) == 2 && call.ArgumentList[0].IsString() && call.ArgumentList[1].IsString() {
+				if mode := call.Argument(1).String(); len(mode) == 1 {
+					if list, ok := network().state.GetModeList(call.Argument(0).String(), mode[0]); ok {
+						arr, _ := js.Object("([])")
+						for _, entry := range list {
+							obj, _ := js.Object("({})")
+							obj.Set("Mask", entry.Mask)
+							obj.Set("SetBy", entry.SetBy)
+							if !entry.SetAt.IsZero() {
+								obj.Set("SetAt", entry.SetAt.Unix())
+							}
+							arr.Call("push", obj)
+						}
+						return arr.Value()
+					}
+				}
+			}
+			return otto.FalseValue()
+		},
+		HasCap: func(call otto.FunctionCall) otto.Value {
+			if len(call.ArgumentList) == 1 && call.ArgumentList[0].IsString() {
+				if network().state.HasCap(call.Argument(0).String()) {
+					return otto.TrueValue()
+				}
+			}
+			return otto.FalseValue()
+		},
+		HasPermission: func(call otto.FunctionCall) otto.Value {
+			if len(call.ArgumentList) == 3 && call.ArgumentList[0].IsString() && call.ArgumentList[1].IsString() && call.ArgumentList[2].IsString() {
+				if network().perms.Can(call.Argument(0).String(), call.Argument(1).String(), call.Argument(2).String()) {
+					return otto.TrueValue()
+				}
+			}
+			return otto.FalseValue()
+		},
 		Redispatch: func(call otto.FunctionCall) otto.Value {
 			if len(call.ArgumentList) >= 7 {
 				arguments := make([]string, 0)
@@ -180,8 +267,10 @@ func (pm *PluginManager) InitIRCJSBridge() {
 					}
 					arguments = append(arguments, arg.String())
 				}
-				utils.IRCRedispatch(
-					pm.conn,
+				// Redispatches are throttled, don't hold up the plugin's
+				// worker meanwhile
+				go utils.IRCRedispatch(
+					network().conn,
 					arguments[0],
 					arguments[1],
 					arguments[2],
@@ -194,6 +283,38 @@ func (pm *PluginManager) InitIRCJSBridge() {
 			}
 			return otto.FalseValue()
 		},
+		GetNetwork: func(call otto.FunctionCall) otto.Value {
+			val, err := otto.ToValue(network().Name)
+			if err != nil {
+				return otto.NullValue()
+			}
+			return val
+		},
+		Networks: func(call otto.FunctionCall) otto.Value {
+			names := make([]string, 0, len(pm.networks))
+			for _, n := range pm.networks {
+				names = append(names, n.Name)
+			}
+			return utils.SliceToJavascriptArray(js, names)
+		},
+		Network: func(call otto.FunctionCall) otto.Value {
+			if len(call.ArgumentList) == 1 && call.ArgumentList[0].IsString() {
+				if n, ok := pm.network(call.Argument(0).String()); ok {
+					if val, err := js.ToValue(pm.newIRCJSBridge(p, func() *Network { return n })); err == nil {
+						return val
+					}
+				}
+			}
+			return otto.FalseValue()
+		},
+	}
+
+	if !p.granted(CapRaw) {
+		bridge.SendRaw = p.denied("IRC.SendRaw", CapRaw)
+		bridge.Redispatch = p.denied("IRC.Redispatch", CapRaw)
+	}
+	if !p.granted(CapOper) {
+		bridge.Oper = p.denied("IRC.Oper", CapOper)
 	}
-	pm.js.Set("IRC", bridge)
+	return bridge
 }
@@ -1,27 +1,42 @@
 package plugins
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/robertkrimen/otto"
 	"github.com/thoj/go-ircevent"
 	"github.com/zenithar/aktarus/config"
-	"github.com/zenithar/aktarus/state"
+	"github.com/zenithar/aktarus/debug"
+	"github.com/zenithar/aktarus/store"
 	"github.com/zenithar/aktarus/utils"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 type PluginManager struct {
-	plugins map[string]*Plugin
-	log     *log.Logger
-	js      *otto.Otto
-	cfg     *config.Settings
-	conn    *irc.Connection
-	state   *state.StateTracker
+	plugins  map[string]*Plugin
+	log      *log.Logger
+	cfg      *config.Settings
+	store    *store.Store
+	networks []*Network
+
+	// Plugins unloaded with !plugin unload, which the watcher leaves
+	// alone until they are loaded again
+	unloaded map[string]bool
+
+	// Guards plugins and unloaded, each plugin running its JS in its own
+	// worker
+	mutex sync.Mutex
 }
 
 // Walker func
@@ -31,15 +46,18 @@ func (pm *PluginManager) traversePluginDir(path string, info os.FileInfo, err er
 		return err
 	}
 
-	// Skip hidden files and folders
-	if filepath.HasPrefix(info.Name(), ".") {
+	// Skip hidden files and folders, like the plugin history
+	if filepath.HasPrefix(info.Name(), ".") && path != pm.cfg.Irc.PluginsDir {
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
 		return nil
 	}
 
 	if ext := strings.ToLower(filepath.Ext(info.Name())); info.Mode().IsRegular() && ext == ".js" {
-		pErr := pm.LoadPlugin(path)
+		pErr := pm.loadPlugin(path)
 		if pErr != nil {
-			pm.log.Printf("Skipping plugin file `%s`: %s\n", path, err)
+			pm.log.Printf("Skipping plugin file `%s`: %s\n", path, pErr)
 		}
 	}
 	return nil
@@ -60,7 +78,159 @@ func (pm *PluginManager) LoadPlugins() {
 	}
 }
 
-func (pm *PluginManager) LoadPlugin(path string) error {
+// Returns the file name of a plugin named with or without its .js
+// extension
+func pluginName(name string) (string, error) {
+	name = strings.TrimSuffix(name, ".js") + ".js"
+	if filepath.Base(name) != name || filepath.HasPrefix(name, ".") {
+		return "", fmt.Errorf("Invalid plugin name `%s`", name)
+	}
+	return name, nil
+}
+
+// Loads a plugin from the plugin directory, leaving the others running
+func (pm *PluginManager) LoadPlugin(name string) error {
+	name, err := pluginName(name)
+	if err != nil {
+		return err
+	}
+
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	if _, ok := pm.plugins[name]; ok {
+		return fmt.Errorf("Plugin `%s` is already loaded", name)
+	}
+	return pm.loadPlugin(filepath.Join(pm.cfg.Irc.PluginsDir, name))
+}
+
+// Reloads a single plugin from its file, keeping the loaded version when
+// the new one fails to run
+func (pm *PluginManager) ReloadPlugin(name string) error {
+	name, err := pluginName(name)
+	if err != nil {
+		return err
+	}
+
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	plugin, ok := pm.plugins[name]
+	if !ok {
+		return fmt.Errorf("Plugin `%s` is not loaded", name)
+	}
+	return pm.loadPlugin(plugin.path)
+}
+
+// Unloads a single plugin, leaving the others running
+func (pm *PluginManager) UnloadPlugin(name string) error {
+	name, err := pluginName(name)
+	if err != nil {
+		return err
+	}
+
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	plugin, ok := pm.plugins[name]
+	if !ok {
+		return fmt.Errorf("Plugin `%s` is not loaded", name)
+	}
+	plugin.stop()
+	delete(pm.plugins, name)
+	pm.unloaded[name] = true
+	runtime.GC()
+	return nil
+}
+
+// Disables or enables a plugin, which stays that way across restarts
+func (pm *PluginManager) SetPluginDisabled(name string, disabled bool) error {
+	name, err := pluginName(name)
+	if err != nil {
+		return err
+	}
+
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	plugin, ok := pm.plugins[name]
+	if !ok {
+		return fmt.Errorf("Plugin `%s` is not loaded", name)
+	}
+	if err := pm.saveDisabled(name, disabled); err != nil {
+		return err
+	}
+	plugin.setDisabled(disabled)
+	return nil
+}
+
+// Store namespace the manager keeps its own state in, out of reach of
+// plugins since a plugin file named .js is hidden
+const managerNamespace = ""
+
+// Returns the plugins disabled with SetPluginDisabled
+func (pm *PluginManager) disabledPlugins() map[string]bool {
+	disabled := make(map[string]bool)
+	if data, ok := pm.store.Namespace(managerNamespace).Get("disabled"); ok {
+		var names []string
+		if err := json.Unmarshal(data, &names); err != nil {
+			pm.log.Printf("Couldn't read the disabled plugins: %s\n", err)
+		}
+		for _, name := range names {
+			disabled[name] = true
+		}
+	}
+	return disabled
+}
+
+// Adds the plugin to the disabled plugins, or removes it
+func (pm *PluginManager) saveDisabled(name string, disabled bool) error {
+	set := pm.disabledPlugins()
+	if disabled {
+		set[name] = true
+	} else {
+		delete(set, name)
+	}
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	data, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+	return pm.store.Namespace(managerNamespace).Set("disabled", data)
+}
+
+// A loaded plugin, as listed by !plugin list
+type PluginInfo struct {
+	Name     string
+	Manifest Manifest
+	Disabled bool
+}
+
+// Returns the loaded plugins, sorted by name
+func (pm *PluginManager) Plugins() []PluginInfo {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	plugins := make([]PluginInfo, 0, len(pm.plugins))
+	for name, plugin := range pm.plugins {
+		plugins = append(plugins, PluginInfo{
+			Name:     name,
+			Manifest: *plugin.manifest,
+			Disabled: plugin.Disabled(),
+		})
+	}
+	sort.Slice(plugins, func(i, j int) bool {
+		return plugins[i].Name < plugins[j].Name
+	})
+	return plugins
+}
+
+func (pm *PluginManager) loadPlugin(path string) error {
 	plugin, err := ioutil.ReadFile(path)
 	if err != nil {
 		pm.log.Printf("Couldn't read plugin file `%s`: %s\n", path, err)
@@ -69,15 +239,67 @@ func (pm *PluginManager) LoadPlugin(path string) error {
 
 	name := filepath.Base(path)
 	log := log.New(os.Stdout, "["+name+"] ", log.LstdFlags)
-	pm.plugins[name] = &Plugin{
+
+	manifest, err := readManifest(path, string(plugin))
+	if err != nil {
+		pm.log.Printf("Couldn't read the manifest of plugin `%s`: %s\n", name, err)
+		return err
+	}
+	if manifest.Name == "" {
+		manifest.Name = strings.TrimSuffix(name, ".js")
+	}
+	granted, missing := manifest.Grants(pm.cfg.PluginGrants(name))
+	if len(missing) > 0 {
+		pm.log.Printf("Plugin `%s` requires %s, which config doesn't grant it\n", name, strings.Join(missing, ", "))
+	}
+	caps := make(map[string]bool, len(granted))
+	for _, capability := range granted {
+		caps[capability] = true
+	}
+
+	// Every plugin gets a VM of its own, so its globals, errors and
+	// reloads can't affect the other plugins
+	js := otto.New()
+	js.Interrupt = make(chan func(), 1)
+	p := &Plugin{
 		commands:  make(map[string]*pluginFunc),
 		callbacks: make(map[string][]*pluginFunc),
 		log:       log,
-		js:        pm.js,
+		js:        js,
 		cfg:       pm.cfg,
+		path:      path,
+		hash:      pluginHash(path, plugin),
+		manifest:  manifest,
+		caps:      caps,
+		events:    make(chan pluginEvent, maxPluginQueue),
+		quit:      make(chan bool),
+	}
+
+	if pm.disabledPlugins()[name] {
+		p.setDisabled(true)
+	}
+
+	// Bridges act on the network of the event being handled, or on the
+	// first network outside of event handling
+	network := func() *Network {
+		if p.network != nil {
+			return p.network
+		}
+		return pm.networks[0]
+	}
+
+	// Setup the bridges, before running the plugin in case it uses them
+	// for init
+	pm.InitConfigJSBridge(p, network)
+	pm.InitIRCJSBridge(p, network)
+	pm.InitUtilsJSBridge(p)
+	pm.InitDebugJSBridge(js)
+	if p.granted(CapStorage) {
+		pm.InitStoreJSBridge(js, pm.store.Namespace(strings.TrimSuffix(name, ".js")))
 	}
+	p.InitTimerJSBridge()
 
-	pm.js.Set("log", func(call otto.FunctionCall) otto.Value {
+	js.Set("log", func(call otto.FunctionCall) otto.Value {
 		if len(call.ArgumentList) == 1 && call.ArgumentList[0].IsString() {
 			log.Println(call.ArgumentList[0].String())
 			return otto.TrueValue()
@@ -86,13 +308,35 @@ func (pm *PluginManager) LoadPlugin(path string) error {
 		}
 	})
 
-	// Add in function to Register !commands
-	pm.js.Set("RegisterCommand", func(call otto.FunctionCall) otto.Value {
-		if len(call.ArgumentList) >= 3 && call.ArgumentList[0].IsString() && call.ArgumentList[1].IsFunction() && call.ArgumentList[2].IsString() {
+	// Add in function to Register !commands, with either its help or an
+	// options object (see commandOptions). A help followed by an options
+	// object is still accepted.
+	js.Set("RegisterCommand", func(call otto.FunctionCall) otto.Value {
+		if len(call.ArgumentList) >= 2 && call.ArgumentList[0].IsString() && call.ArgumentList[1].IsFunction() {
 			command := call.ArgumentList[0].String()
 			f := call.ArgumentList[1]
-			help := call.ArgumentList[2].String()
-			pm.plugins[name].SetCommand(command, f, help)
+			options := newCommandOptions(command, "")
+			var err error
+			switch {
+			case len(call.ArgumentList) == 2:
+			case call.ArgumentList[2].IsString():
+				options.help = call.ArgumentList[2].String()
+				if len(call.ArgumentList) >= 4 && call.ArgumentList[3].IsObject() {
+					err = options.parse(call.ArgumentList[3].Object())
+					if options.help == "" {
+						options.help = call.ArgumentList[2].String()
+					}
+				}
+			case call.ArgumentList[2].IsObject():
+				err = options.parse(call.ArgumentList[2].Object())
+			default:
+				return otto.FalseValue()
+			}
+			if err != nil {
+				pm.log.Printf("Couldn't register command `%s` from plugin `%s`: %s\n", command, name, err)
+				return otto.FalseValue()
+			}
+			p.SetCommand(command, f, options)
 			if pm.cfg.Irc.Debug || pm.cfg.Debug {
 				pm.log.Printf("Registered command `%s` from plugin `%s`\n", command, name)
 			}
@@ -103,12 +347,12 @@ func (pm *PluginManager) LoadPlugin(path string) error {
 	})
 
 	// Add in function to register callbacks
-	pm.js.Set("RegisterCallback", func(call otto.FunctionCall) otto.Value {
+	js.Set("RegisterCallback", func(call otto.FunctionCall) otto.Value {
 		if len(call.ArgumentList) >= 3 && call.ArgumentList[0].IsString() && call.ArgumentList[1].IsString() && call.ArgumentList[2].IsFunction() {
 			eventCode := call.ArgumentList[0].String()
 			callbackName := call.ArgumentList[1].String()
 			f := call.ArgumentList[2]
-			pm.plugins[name].AddCallback(eventCode, callbackName, f)
+			p.AddCallback(eventCode, callbackName, f)
 			if pm.cfg.Irc.Debug || pm.cfg.Debug {
 				pm.log.Printf("Registered callback `%s` from plugin `%s`\n", callbackName, name)
 			}
@@ -119,81 +363,146 @@ func (pm *PluginManager) LoadPlugin(path string) error {
 	})
 
 	// Now we have defined the required registration commands in the JS
-	// execution context, we run the plugin file contents
-	_, err = pm.js.Run(string(plugin))
+	// execution context, we run the plugin file contents, within the same
+	// time limit as commands and callbacks
+	timeout := time.Duration(pm.cfg.Irc.PluginTimeout) * time.Second
+	err = runWithDeadline(js, timeout, func() error {
+		_, err := js.Run(string(plugin))
+		return locateError(err)
+	}, func() {})
+	if err != nil {
+		pm.log.Printf("Error interpreting plugin code for plugin `%s`: %s\n", name, err)
+		p.stopTimers()
+		return err
+	}
 
 	// And now we remove the functions, since they aren't needed during
 	// normal operations
-	pm.js.Set("RegisterCommand", nil)
-	pm.js.Set("RegisterCallback", nil)
-	pm.js.Set("log", nil)
+	js.Set("RegisterCommand", nil)
+	js.Set("RegisterCallback", nil)
 
-	if err != nil {
-		pm.log.Printf("Error interpreting plugin code for plugin `%s`: %s\n", name, err)
-		delete(pm.plugins, name)
-		return err
+	// Replaces the previous version of the plugin, if any
+	if previous, ok := pm.plugins[name]; ok {
+		previous.stop()
 	}
+	pm.plugins[name] = p
+	delete(pm.unloaded, name)
+	p.start()
 	return nil
 }
 
-func (pm *PluginManager) runCallbacks(event *irc.Event) {
+// Adds where a runtime JS error happened to its message, syntax errors
+// already giving their line and column
+func locateError(err error) error {
+	if jsErr, ok := err.(*otto.Error); ok {
+		lines := strings.Split(strings.TrimSpace(jsErr.String()), "\n")
+		if len(lines) > 1 {
+			return fmt.Errorf("%s (%s)", lines[0], strings.TrimSpace(lines[1]))
+		}
+	}
+	return err
+}
+
+func (pm *PluginManager) runCallbacks(network *Network, event *irc.Event) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
 	if pm.cfg.Irc.Debug || pm.cfg.Debug {
-		pm.log.Printf("Looking for plugin callbacks for event `%s`...\n", event.Code)
+		pm.log.Printf("Looking for plugin callbacks for event `%s` on `%s`...\n", event.Code, network.Name)
 	}
 	for name, plugin := range pm.plugins {
+		if !pm.pluginAllowed(network, name, event) {
+			continue
+		}
 		if pm.cfg.Irc.Debug || pm.cfg.Debug {
 			pm.log.Printf("Dispatching event `%s` to plugin `%s` callbacks\n", event.Code, name)
 		}
-		plugin.RunCallbacks(event)
+		plugin.enqueue(network, event, false)
 	}
 }
 
-func (pm *PluginManager) runCommands(event *irc.Event) {
+func (pm *PluginManager) runCommands(network *Network, event *irc.Event) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
 	for name, plugin := range pm.plugins {
-		if pm.cfg.Irc.Debug || pm.cfg.Debug {
-			pm.log.Printf("Dispatching event `%s` to plugin `%s` commands\n", event.Code, name)
+		if !pm.pluginAllowed(network, name, event) {
+			continue
 		}
 		// Stop processing as soon as a command is found in a plugin
-		if plugin.RunCommand(event) {
+		if _, ok := plugin.Command(network, event); ok {
+			if pm.cfg.Irc.Debug || pm.cfg.Debug {
+				pm.log.Printf("Dispatching event `%s` to plugin `%s` commands\n", event.Code, name)
+			}
+			plugin.enqueue(network, event, true)
 			return
 		}
 	}
 }
 
-func (pm *PluginManager) InitPluginCallbacks() {
+// Returns the number of events waiting for each plugin
+func (pm *PluginManager) QueueDepths() map[string]int {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	depths := make(map[string]int, len(pm.plugins))
+	for name, plugin := range pm.plugins {
+		depths[name] = plugin.QueueDepth()
+	}
+	return depths
+}
+
+// Whether the channel an event happened in lets the plugin see it
+func (pm *PluginManager) pluginAllowed(network *Network, name string, event *irc.Event) bool {
+	if len(event.Arguments) == 0 {
+		return true
+	}
+	if settings, ok := network.state.ChannelConfig(event.Arguments[0]); ok {
+		return settings.AllowsPlugin(name)
+	}
+	return true
+}
+
+// Dispatches the network's events to the plugins
+func (pm *PluginManager) InitPluginCallbacks(network *Network) {
 	// Callback dispatcher for plugin callbacks
-	pm.conn.AddCallback("*", pm.runCallbacks)
+	network.conn.AddCallback("*", func(event *irc.Event) {
+		pm.runCallbacks(network, event)
+	})
 
 	// Callback dispatcher for plugin commands
-	pm.conn.AddCallback("PRIVMSG", pm.runCommands)
+	network.conn.AddCallback("PRIVMSG", func(event *irc.Event) {
+		pm.runCommands(network, event)
+	})
 }
 
 func (pm *PluginManager) InitJS() {
-	// Initialise plugins / ditch existing plugins by redeclaring
-	pm.plugins = make(map[string]*Plugin)
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
 
-	// Init js env / redeclare to bin old env
-	pm.js = otto.New()
+	// Initialise plugins / ditch existing plugins, and their VMs, by
+	// redeclaring
+	for _, plugin := range pm.plugins {
+		plugin.stop()
+	}
+	pm.plugins = make(map[string]*Plugin)
 
 	// Force a GC incase we are doing a redeclare
 	runtime.GC()
 
-	// Setup the JS config access (we do this before loading plugins, incase plugins use the config for init)
-	pm.InitConfigJSBridge()
-
 	// Load the plugins
 	pm.LoadPlugins()
-
-	// Init the JS Execution environment hooks. Do this after loading since as
-	pm.InitIRCJSBridge()
-	pm.InitUtilsJSBridge()
-	pm.InitDebugJSBridge()
 }
 
-func (pm *PluginManager) CommandHelp() map[string]string {
+// Returns the help of every plugin command, commands being shown with
+// prefix
+func (pm *PluginManager) CommandHelp(prefix string) map[string]string {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
 	var commands map[string]string = make(map[string]string, 0)
 	for _, plugin := range pm.plugins {
-		for name, help := range plugin.CommandHelp() {
+		for name, help := range plugin.CommandHelp(prefix) {
 			// Since we don't dispatch to plugins after first match
 			// don't bother listing additionals here either
 			if _, ok := commands[name]; !ok {
@@ -204,50 +513,81 @@ func (pm *PluginManager) CommandHelp() map[string]string {
 	return commands
 }
 
-func (pm *PluginManager) ImportPlugin(who, url, name string, overwrite bool) (err error) {
+// Imports the plugin at url as name.js, checking it against the sha256
+// checksum when given, and loads it. A plugin failing to run is rolled
+// back to the version it replaced. Returns the plugin's manifest so the
+// capabilities it requires can be reviewed.
+func (pm *PluginManager) ImportPlugin(who, url, name string, overwrite bool, checksum string) (*Manifest, error) {
 	pm.log.Printf("%s is importing a plugin from: %s, called %s.js. Overwrite is %v\n", who, url, name, overwrite)
-	var plugin string
-	if plugin, err = utils.GetPage(url); err == nil {
-		js := otto.New()
-		js.Set("RegisterCommand", func(call otto.FunctionCall) otto.Value { return otto.UndefinedValue() })
-		js.Set("RegisterCallback", func(call otto.FunctionCall) otto.Value { return otto.UndefinedValue() })
-		js.Set("log", func(call otto.FunctionCall) otto.Value { return otto.UndefinedValue() })
-		_, err = js.Run(plugin)
-		if err == nil {
-			js = nil
-			_, err = os.Stat(pm.cfg.Irc.PluginsDir)
-			if err == nil {
-				file := filepath.Join(pm.cfg.Irc.PluginsDir, name+".js")
-				_, err = os.Stat(file)
-				if err != nil && os.IsNotExist(err) {
-					// Write plugin to file
-					err = ioutil.WriteFile(file, []byte(plugin), 0644)
-				} else if err == nil && overwrite {
-					err = ioutil.WriteFile(file, []byte(plugin), 0644)
-				} else if err == nil {
-					err = errors.New("Will not overwrite existing plugin")
-				}
-			} else if os.IsNotExist(err) {
-				pm.log.Printf("Plugin directory does not exist: %s\n", err)
-			} else {
-				pm.log.Printf("Error accessing plugin directory: %s\n", err)
-			}
+	manifest, err := pm.importPlugin(url, name, overwrite, checksum)
+	if err != nil {
+		pm.log.Printf("Error importing plugin: %s\n", err)
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func (pm *PluginManager) importPlugin(url, name string, overwrite bool, checksum string) (*Manifest, error) {
+	file, err := pluginName(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(pm.cfg.Irc.PluginsDir); err != nil {
+		return nil, err
+	}
+
+	plugin, err := utils.GetPageLimited(url, pm.cfg.Irc.ImportMaxSize)
+	if err != nil {
+		return nil, err
+	}
+	if checksum != "" {
+		sum := sha256.Sum256([]byte(plugin))
+		if !strings.EqualFold(hex.EncodeToString(sum[:]), checksum) {
+			return nil, fmt.Errorf("Checksum mismatch, the plugin's sha256 is %x", sum)
 		}
 	}
+
+	manifest, err := ParseManifest(plugin)
 	if err != nil {
-		pm.log.Printf("Error importing plugin: %s\n", err)
-		return
+		return nil, err
 	}
-	pm.InitJS()
-	return nil
+	if manifest.Name == "" {
+		manifest.Name = strings.TrimSuffix(file, ".js")
+	}
+	pm.log.Printf("Imported plugin is %s\n", manifest.Summary(pm.cfg.PluginGrants(file)))
+
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	path := filepath.Join(pm.cfg.Irc.PluginsDir, file)
+	previous, err := ioutil.ReadFile(path)
+	if err == nil && !overwrite {
+		return nil, errors.New("Will not overwrite existing plugin")
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err := pm.installPlugin(path, []byte(plugin), previous); err != nil {
+		return nil, err
+	}
+	if previous != nil {
+		if err := pm.archivePlugin(file, previous); err != nil {
+			pm.log.Printf("Couldn't archive the previous version of `%s`: %s\n", file, err)
+		}
+	}
+	return manifest, nil
 }
 
-func New(cfg *config.Settings, conn *irc.Connection, state *state.StateTracker) *PluginManager {
-	return &PluginManager{
-		plugins: make(map[string]*Plugin),
-		log:     log.New(os.Stdout, "[plugins] ", log.LstdFlags),
-		cfg:     cfg,
-		conn:    conn,
-		state:   state,
+func New(cfg *config.Settings, store *store.Store) *PluginManager {
+	pm := &PluginManager{
+		plugins:  make(map[string]*Plugin),
+		unloaded: make(map[string]bool),
+		log:      log.New(os.Stdout, "[plugins] ", log.LstdFlags),
+		cfg:      cfg,
+		store:    store,
 	}
+
+	// Give debug a window into the plugin queues
+	debug.SetPluginQueues(pm.QueueDepths)
+	return pm
 }
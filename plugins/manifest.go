@@ -0,0 +1,153 @@
+package plugins
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Capabilities a plugin may require, each giving access to bridge
+// functions only installed once granted in config
+const (
+	CapRaw     = "raw"     // IRC.SendRaw and IRC.Redispatch
+	CapOper    = "oper"    // IRC.Oper
+	CapNetwork = "network" // UTILS.GetPage and UTILS.ExtractTitle
+	CapConfig  = "config"  // GetConfig, and channel keys in GetChannelConfig
+	CapStorage = "storage" // STORE
+)
+
+var capabilities = []string{CapRaw, CapOper, CapNetwork, CapConfig, CapStorage}
+
+// What a plugin says about itself, either in a sidecar name.json file or
+// in `// @key value` comment lines at the top of the plugin:
+//
+//	// @name url_titler
+//	// @version 1.0
+//	// @requires network, storage
+type Manifest struct {
+	Name        string   `json:"name"`
+	Version     string   `json:"version"`
+	Author      string   `json:"author"`
+	Description string   `json:"description"`
+	Requires    []string `json:"requires"`
+}
+
+// Reads the manifest of the plugin at path, from its sidecar file when
+// there is one, or else from the header comment of its code
+func readManifest(path string, code string) (*Manifest, error) {
+	sidecar := strings.TrimSuffix(path, filepath.Ext(path)) + ".json"
+	data, err := ioutil.ReadFile(sidecar)
+	if os.IsNotExist(err) {
+		return ParseManifest(code)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest `%s`: %s", sidecar, err)
+	}
+	return &m, m.validate()
+}
+
+// Parses the manifest from the comment lines code starts with, plugins
+// without one requiring nothing
+func ParseManifest(code string) (*Manifest, error) {
+	m := &Manifest{}
+	for _, line := range strings.Split(code, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "//") {
+			break
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "//"))
+		if !strings.HasPrefix(line, "@") {
+			continue
+		}
+
+		fields := strings.SplitN(line[1:], " ", 2)
+		var value string
+		if len(fields) == 2 {
+			value = strings.TrimSpace(fields[1])
+		}
+		switch strings.ToLower(fields[0]) {
+		case "name":
+			m.Name = value
+		case "version":
+			m.Version = value
+		case "author":
+			m.Author = value
+		case "description":
+			m.Description = value
+		case "requires":
+			m.Requires = append(m.Requires, strings.FieldsFunc(value, func(r rune) bool {
+				return r == ',' || r == ' ' || r == '\t'
+			})...)
+		}
+	}
+	return m, m.validate()
+}
+
+// Checks the manifest only requires known capabilities
+func (m *Manifest) validate() error {
+	for i, required := range m.Requires {
+		m.Requires[i] = strings.ToLower(required)
+		if !knownCapability(m.Requires[i]) {
+			return fmt.Errorf("unknown capability `%s` required, should be one of %s", required, strings.Join(capabilities, ", "))
+		}
+	}
+	return nil
+}
+
+func knownCapability(capability string) bool {
+	for _, known := range capabilities {
+		if capability == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Splits the capabilities the manifest requires into those in grants and
+// those missing from it
+func (m *Manifest) Grants(grants []string) (granted, missing []string) {
+	for _, required := range m.Requires {
+		ok := false
+		for _, grant := range grants {
+			ok = ok || strings.EqualFold(grant, required)
+		}
+		if ok {
+			granted = append(granted, required)
+		} else {
+			missing = append(missing, required)
+		}
+	}
+	return granted, missing
+}
+
+// Returns a one line summary of the manifest and what it was granted
+func (m *Manifest) Summary(grants []string) string {
+	summary := m.Name
+	if m.Version != "" {
+		summary += " " + m.Version
+	}
+	if m.Author != "" {
+		summary += " by " + m.Author
+	}
+	if len(m.Requires) == 0 {
+		return summary + ", requiring no capabilities"
+	}
+	_, missing := m.Grants(grants)
+	summary += ", requiring " + strings.Join(m.Requires, ", ")
+	if len(missing) > 0 {
+		summary += fmt.Sprintf(" (not granted: %s)", strings.Join(missing, ", "))
+	} else {
+		summary += " (all granted)"
+	}
+	return summary
+}
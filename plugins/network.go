@@ -0,0 +1,52 @@
+package plugins
+
+import (
+	"github.com/thoj/go-ircevent"
+	"github.com/zenithar/aktarus/config"
+	"github.com/zenithar/aktarus/permissions"
+	"github.com/zenithar/aktarus/queue"
+	"github.com/zenithar/aktarus/state"
+)
+
+// A network the bot is connected to, all of them sharing the plugins
+type Network struct {
+	Name  string
+	cfg   *config.Settings
+	conn  *irc.Connection
+	queue *queue.Queue
+	state *state.StateTracker
+	perms *permissions.Manager
+}
+
+// Makes the plugins available on a network
+func (pm *PluginManager) AddNetwork(cfg *config.Settings, conn *irc.Connection, queue *queue.Queue, state *state.StateTracker, perms *permissions.Manager) *Network {
+	network := &Network{
+		Name:  cfg.Name,
+		cfg:   cfg,
+		conn:  conn,
+		queue: queue,
+		state: state,
+		perms: perms,
+	}
+	pm.networks = append(pm.networks, network)
+	return network
+}
+
+// Returns the network with the given name
+func (pm *PluginManager) network(name string) (*Network, bool) {
+	for _, network := range pm.networks {
+		if network.Name == name {
+			return network, true
+		}
+	}
+	return nil, false
+}
+
+// Sends a message to the staff channels of every network
+func (pm *PluginManager) alertStaff(message string) {
+	for _, network := range pm.networks {
+		for _, channel := range network.cfg.ChannelsWithRole(config.StaffRole) {
+			network.queue.Privmsg(channel.Name, message)
+		}
+	}
+}
@@ -1,17 +1,24 @@
 package plugins
 
 import (
+	"fmt"
 	"github.com/robertkrimen/otto"
 	"github.com/thoj/go-ircevent"
 	"github.com/zenithar/aktarus/config"
+	"github.com/zenithar/aktarus/state"
 	"github.com/zenithar/aktarus/utils"
 	"log"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type pluginFunc struct {
-	function func(otto.Value)
+	function func(network *Network, env func() otto.Value)
 	help     string
+
+	// Options of commands, nil for callbacks
+	options *commandOptions
 }
 
 type Plugin struct {
@@ -20,32 +27,128 @@ type Plugin struct {
 	log       *log.Logger
 	js        *otto.Otto
 	cfg       *config.Settings
+	path      string
+
+	// sha256 of the code and sidecar manifest the plugin was loaded from
+	hash string
+
+	// What the plugin says about itself, and the capabilities it both
+	// requires and was granted
+	manifest *Manifest
+	caps     map[string]bool
+
+	// Network of the event being handled, nil outside of event handling.
+	// Only used from the goroutine running JS in the VM
+	network *Network
+
+	// Events waiting for the plugin's worker
+	events chan pluginEvent
+	quit   chan bool
+
+	// Jobs set up with setTimeout, setInterval and Schedule, nil once the
+	// plugin is stopped
+	timers     map[int]*pluginTimer
+	nextTimer  int
+	timerMutex sync.Mutex
+
+	// Only accessed atomically. running is set while a function runs in
+	// the VM, timeouts counts the timeouts in a row
+	running, disabled, timeouts int32
 }
 
-func (p *Plugin) SetCommand(name string, command otto.Value, help string) {
-	if _, ok := p.commands[name]; ok {
-		if p.cfg.Irc.Debug || p.cfg.Debug {
-			p.log.Printf("Warning: Command `%s` was already defined. Overriding...", name)
-		}
+// Whether the plugin was disabled
+func (p *Plugin) Disabled() bool {
+	return atomic.LoadInt32(&p.disabled) == 1
+}
+
+// Disables or enables the plugin, enabling it forgetting its timeouts
+func (p *Plugin) setDisabled(disabled bool) {
+	if disabled {
+		atomic.StoreInt32(&p.disabled, 1)
+		return
+	}
+	atomic.StoreInt32(&p.timeouts, 0)
+	atomic.StoreInt32(&p.disabled, 0)
+}
+
+// Whether the plugin was granted the capability
+func (p *Plugin) granted(capability string) bool {
+	return p.caps[capability]
+}
+
+// Returns a bridge function standing in for one needing a capability the
+// plugin wasn't granted
+func (p *Plugin) denied(function, capability string) func(call otto.FunctionCall) otto.Value {
+	return func(call otto.FunctionCall) otto.Value {
+		p.log.Printf("%s needs the `%s` capability, which the plugin wasn't granted\n", function, capability)
+		return otto.FalseValue()
+	}
+}
+
+// Runs fn in the plugin's VM for an event of network within the configured
+// time limit, disabling the plugin when it keeps running out of time
+func (p *Plugin) call(network *Network, what string, fn func() error) {
+	if p.Disabled() {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&p.running, 0, 1) {
+		p.log.Printf("%s skipped, the plugin is still stuck in a previous call\n", what)
+		return
 	}
-	wrappedCommand := func(env otto.Value) {
-		_, err := command.Call(env)
-		if err != nil {
-			p.log.Printf("Command `%s` errored: %s", name, err)
+
+	timeout := time.Duration(p.cfg.Irc.PluginTimeout) * time.Second
+	err := runWithDeadline(p.js, timeout, func() error {
+		p.network = network
+		defer func() { p.network = nil }()
+		return fn()
+	}, func() {
+		atomic.StoreInt32(&p.running, 0)
+	})
+
+	switch {
+	case err == errTimeout:
+		p.log.Printf("%s exceeded its %s time limit and was interrupted\n", what, timeout)
+		timeouts := atomic.AddInt32(&p.timeouts, 1)
+		if max := p.cfg.Irc.PluginMaxTimeouts; max > 0 && int(timeouts) >= max {
+			atomic.StoreInt32(&p.disabled, 1)
+			p.log.Printf("Disabled the plugin after %d timeouts in a row\n", timeouts)
 		}
+		return
+	case err != nil:
+		p.log.Printf("%s errored: %s\n", what, err)
+	}
+	atomic.StoreInt32(&p.timeouts, 0)
+}
+
+// Registers a command under its name and aliases
+func (p *Plugin) SetCommand(name string, command otto.Value, options *commandOptions) {
+	wrappedCommand := func(network *Network, env func() otto.Value) {
+		p.call(network, fmt.Sprintf("Command `%s`", name), func() error {
+			_, err := command.Call(env())
+			return err
+		})
 	}
-	p.commands[name] = &pluginFunc{
+	cmd := &pluginFunc{
 		function: wrappedCommand,
-		help:     help,
+		help:     options.help,
+		options:  options,
+	}
+	for _, name := range append([]string{name}, options.aliases...) {
+		if _, ok := p.commands[name]; ok {
+			if p.cfg.Irc.Debug || p.cfg.Debug {
+				p.log.Printf("Warning: Command `%s` was already defined. Overriding...", name)
+			}
+		}
+		p.commands[name] = cmd
 	}
 }
 
 func (p *Plugin) AddCallback(eventCode string, name string, callback otto.Value) {
-	wrappedCallback := func(env otto.Value) {
-		_, err := callback.Call(env)
-		if err != nil {
-			p.log.Printf("Callback `%s` (%#v) for event code `%s` errored: %s", name, callback, eventCode, err)
-		}
+	wrappedCallback := func(network *Network, env func() otto.Value) {
+		p.call(network, fmt.Sprintf("Callback `%s` for event code `%s`", name, eventCode), func() error {
+			_, err := callback.Call(env())
+			return err
+		})
 	}
 	p.callbacks[eventCode] = append(p.callbacks[eventCode], &pluginFunc{
 		function: wrappedCallback,
@@ -53,14 +156,18 @@ func (p *Plugin) AddCallback(eventCode string, name string, callback otto.Value)
 	})
 }
 
-func (p *Plugin) RunCallbacks(event *irc.Event) {
+func (p *Plugin) RunCallbacks(network *Network, event *irc.Event) {
+	if p.Disabled() {
+		return
+	}
+
 	if callbacks, ok := p.callbacks[event.Code]; ok {
 		if p.cfg.Irc.Debug || p.cfg.Debug {
 			p.log.Printf("%v (%v) >> %#v\n", event.Code, len(callbacks), event)
 		}
 
 		for _, callback := range callbacks {
-			callback.function(p.jsEnv(event))
+			callback.function(network, func() otto.Value { return p.jsEnv(network, event) })
 		}
 	}
 
@@ -71,41 +178,83 @@ func (p *Plugin) RunCallbacks(event *irc.Event) {
 		}
 
 		for _, callback := range callbacks {
-			callback.function(p.jsEnv(event))
+			callback.function(network, func() otto.Value { return p.jsEnv(network, event) })
 		}
 	}
 }
 
-func (p *Plugin) RunCommand(event *irc.Event) bool {
-	if event.Message()[0] == '!' && len(event.Message()) > 1 {
-		call := strings.SplitN(event.Message()[1:], " ", 2)
-		command := call[0]
+// Returns the plugin command a message calls, if any
+func (p *Plugin) Command(network *Network, event *irc.Event) (state.Command, bool) {
+	if p.Disabled() {
+		return state.Command{}, false
+	}
+	if cmd, ok := network.state.ParseCommand(event); ok {
+		if _, ok := p.commands[cmd.Name]; ok {
+			return cmd, true
+		}
+	}
+	return state.Command{}, false
+}
 
-		var ok bool
-		if _, ok = p.commands[command]; ok {
-			if p.cfg.Irc.Debug || p.cfg.Debug {
-				p.log.Printf("%v (!%v) >> %#v\n", event.Code, command, event)
-			}
+func (p *Plugin) RunCommand(network *Network, event *irc.Event) {
+	if p.Disabled() {
+		return
+	}
+
+	if parsed, ok := p.Command(network, event); ok {
+		command := parsed.Name
+		if p.cfg.Irc.Debug || p.cfg.Debug {
+			p.log.Printf("%v (%v%v) >> %#v\n", event.Code, parsed.Prefix, command, event)
+		}
 
-			cmd := p.commands[command].function
-			cmd(p.jsEnv(event))
+		cmd := p.commands[command]
+		options := cmd.options
+		target := event.Arguments[0]
+		if !options.allowedIn(network, target) {
+			return
 		}
 
-		return ok
+		// Commands declaring a permission are only run for those holding it
+		if options.permission != "" && !network.perms.Can(target, event.Source, options.permission) {
+			network.perms.Deny(network.queue, target, event.Nick)
+			return
+		}
+
+		target = replyTarget(network, event)
+		prefix := network.state.ReplyPrefix(parsed, event.Arguments[0])
+		args := options.parseArgs(parsed.Text)
+		if !options.validArgs(len(args)) {
+			network.queue.Privmsg(target, fmt.Sprintf("%s: %s", event.Nick, options.usageMessage(prefix)))
+			return
+		}
+		if left := options.cooldown(network, event.Nick, event.Arguments[0]); left > 0 {
+			network.queue.Notice(event.Nick, fmt.Sprintf("%s%s can be used again in %d seconds", prefix, command, int(left/time.Second)+1))
+			return
+		}
+
+		cmd.function(network, func() otto.Value {
+			env := p.jsEnv(network, event)
+			env.Object().Set("args", utils.SliceToJavascriptArray(p.js, args))
+			return env
+		})
 	}
-	return false
 }
 
-func (p *Plugin) CommandHelp() map[string]string {
+// Returns the help of each command, commands being shown with prefix and
+// aliases being listed in the help of the command they stand for
+func (p *Plugin) CommandHelp(prefix string) map[string]string {
 	var commands map[string]string = make(map[string]string, 0)
 	for name, cmd := range p.commands {
-		commands["!"+name] = cmd.help
+		if name == cmd.options.name {
+			commands[prefix+name] = cmd.options.helpMessage(prefix)
+		}
 	}
 	return commands
 }
 
-func (p *Plugin) eventToValue(event *irc.Event) otto.Value {
+func (p *Plugin) eventToValue(network *Network, event *irc.Event) otto.Value {
 	obj, _ := p.js.Object("({})")
+	obj.Set("network", network.Name)
 	obj.Set("code", event.Code)
 	obj.Set("raw", event.Raw)
 	obj.Set("nick", event.Nick)
@@ -117,9 +266,19 @@ func (p *Plugin) eventToValue(event *irc.Event) otto.Value {
 	return obj.Value()
 }
 
-func (p *Plugin) jsEnv(event *irc.Event) otto.Value {
+// Returns where replies to an event go: its channel, or the sender for
+// private messages
+func replyTarget(network *Network, event *irc.Event) string {
+	if len(event.Arguments) > 0 && network.state.ServerInfo().IsChannel(event.Arguments[0]) {
+		return event.Arguments[0]
+	}
+	return event.Nick
+}
+
+func (p *Plugin) jsEnv(network *Network, event *irc.Event) otto.Value {
 	obj, _ := p.js.Object("({})")
-	obj.Set("event", p.eventToValue(event))
+	obj.Set("event", p.eventToValue(network, event))
+	obj.Set("target", replyTarget(network, event))
 	obj.Set("log", func(call otto.FunctionCall) otto.Value {
 		if len(call.ArgumentList) == 1 && call.ArgumentList[0].IsString() {
 			p.log.Println(call.ArgumentList[0].String())
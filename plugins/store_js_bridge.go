@@ -0,0 +1,75 @@
+package plugins
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/robertkrimen/otto"
+	"github.com/zenithar/aktarus/store"
+	"github.com/zenithar/aktarus/utils"
+)
+
+type pmStoreJSBridge struct {
+	Get, Set, Delete, List, Increment func(call otto.FunctionCall) otto.Value
+}
+
+func (pm *PluginManager) InitStoreJSBridge(js *otto.Otto, ns *store.Namespace) {
+	bridge := &pmStoreJSBridge{
+		Get: func(call otto.FunctionCall) otto.Value {
+			if len(call.ArgumentList) == 1 && call.ArgumentList[0].IsString() {
+				if value, ok := ns.Get(call.Argument(0).String()); ok {
+					if val, err := js.Call("JSON.parse", nil, string(value)); err == nil {
+						return val
+					}
+				}
+			}
+			return otto.UndefinedValue()
+		},
+		Set: func(call otto.FunctionCall) otto.Value {
+			if len(call.ArgumentList) == 2 && call.ArgumentList[0].IsString() && call.ArgumentList[1].IsDefined() {
+				value, err := js.Call("JSON.stringify", nil, call.Argument(1))
+				if err == nil && !value.IsString() {
+					err = errors.New("value can't be stored as JSON")
+				}
+				if err == nil {
+					if err = ns.Set(call.Argument(0).String(), json.RawMessage(value.String())); err == nil {
+						return otto.TrueValue()
+					}
+				}
+				pm.log.Printf("[STORE] Set errored: %s\n", err)
+			}
+			return otto.FalseValue()
+		},
+		Delete: func(call otto.FunctionCall) otto.Value {
+			if len(call.ArgumentList) == 1 && call.ArgumentList[0].IsString() {
+				if err := ns.Delete(call.Argument(0).String()); err == nil {
+					return otto.TrueValue()
+				}
+			}
+			return otto.FalseValue()
+		},
+		List: func(call otto.FunctionCall) otto.Value {
+			var prefix string
+			if len(call.ArgumentList) == 1 && call.ArgumentList[0].IsString() {
+				prefix = call.Argument(0).String()
+			}
+			return utils.SliceToJavascriptArray(js, ns.List(prefix))
+		},
+		Increment: func(call otto.FunctionCall) otto.Value {
+			if len(call.ArgumentList) >= 1 && call.ArgumentList[0].IsString() {
+				by := 1.0
+				if len(call.ArgumentList) == 2 && call.ArgumentList[1].IsNumber() {
+					by, _ = call.Argument(1).ToFloat()
+				}
+				current, err := ns.Increment(call.Argument(0).String(), by)
+				if err == nil {
+					if val, err := js.ToValue(current); err == nil {
+						return val
+					}
+				}
+				pm.log.Printf("[STORE] Increment errored: %s\n", err)
+			}
+			return otto.FalseValue()
+		},
+	}
+	js.Set("STORE", bridge)
+}
@@ -0,0 +1,212 @@
+package plugins
+
+import (
+	"fmt"
+	"github.com/robertkrimen/otto"
+	"github.com/zenithar/aktarus/utils"
+	"time"
+)
+
+// Shortest period setInterval accepts
+const minTimerInterval = time.Second
+
+// A job set up with setTimeout, setInterval or Schedule
+type pluginTimer struct {
+	id       int
+	what     string
+	function otto.Value
+	args     []interface{}
+
+	// Network of the event being handled when the job was set up
+	network *Network
+
+	// Delay before running, and whether to keep running every delay, or
+	// the cron schedule to run on
+	delay    time.Duration
+	repeat   bool
+	schedule *utils.CronSchedule
+
+	timer *time.Timer
+}
+
+// Registers a job and arms it, returns its id
+func (p *Plugin) addTimer(t *pluginTimer) (int, bool) {
+	p.timerMutex.Lock()
+	defer p.timerMutex.Unlock()
+
+	if p.timers == nil {
+		// The plugin was stopped
+		return 0, false
+	}
+	p.nextTimer++
+	t.id = p.nextTimer
+	p.timers[t.id] = t
+	return t.id, p.armTimer(t)
+}
+
+// Cancels a job
+func (p *Plugin) clearTimer(id int) {
+	p.timerMutex.Lock()
+	defer p.timerMutex.Unlock()
+
+	if t, ok := p.timers[id]; ok {
+		t.timer.Stop()
+		delete(p.timers, id)
+	}
+}
+
+// Cancels every job, for good
+func (p *Plugin) stopTimers() {
+	p.timerMutex.Lock()
+	defer p.timerMutex.Unlock()
+
+	for _, t := range p.timers {
+		t.timer.Stop()
+	}
+	p.timers = nil
+}
+
+// Sets the timer for the job's next run, must be called with timerMutex
+// held
+func (p *Plugin) armTimer(t *pluginTimer) bool {
+	delay := t.delay
+	if t.schedule != nil {
+		next := t.schedule.Next(time.Now())
+		if next.IsZero() {
+			delete(p.timers, t.id)
+			return false
+		}
+		delay = next.Sub(time.Now())
+	}
+	t.timer = time.AfterFunc(delay, func() {
+		p.fireTimer(t)
+	})
+	return true
+}
+
+// Hands a job that is due to the plugin's worker, rearming it when it
+// repeats
+func (p *Plugin) fireTimer(t *pluginTimer) {
+	p.timerMutex.Lock()
+	if _, ok := p.timers[t.id]; !ok {
+		p.timerMutex.Unlock()
+		return
+	}
+	if t.repeat || t.schedule != nil {
+		p.armTimer(t)
+	}
+	p.timerMutex.Unlock()
+
+	select {
+	case p.events <- pluginEvent{timer: t}:
+	default:
+		p.log.Printf("Event queue full, dropping a run of %s\n", t.what)
+	}
+}
+
+// Runs a job, from the plugin's worker
+func (p *Plugin) runTimer(t *pluginTimer) {
+	p.timerMutex.Lock()
+	_, ok := p.timers[t.id]
+	if ok && !t.repeat && t.schedule == nil {
+		delete(p.timers, t.id)
+	}
+	p.timerMutex.Unlock()
+
+	if ok {
+		p.call(t.network, t.what, func() error {
+			_, err := t.function.Call(otto.UndefinedValue(), t.args...)
+			return err
+		})
+	}
+}
+
+// Returns the JS value for a job id, or false when it couldn't be set up
+func (p *Plugin) timerValue(id int, ok bool) otto.Value {
+	if !ok {
+		return otto.FalseValue()
+	}
+	if val, err := p.js.ToValue(id); err == nil {
+		return val
+	}
+	return otto.FalseValue()
+}
+
+// Sets up setTimeout, setInterval, clearTimeout, clearInterval and
+// Schedule, running their jobs through the plugin's worker
+func (p *Plugin) InitTimerJSBridge() {
+	p.timers = make(map[int]*pluginTimer)
+
+	// setTimeout(fn, ms, args...) and setInterval(fn, ms, args...)
+	newTimer := func(call otto.FunctionCall, repeat bool) otto.Value {
+		if len(call.ArgumentList) < 1 || !call.ArgumentList[0].IsFunction() {
+			return otto.FalseValue()
+		}
+		var ms int64
+		if len(call.ArgumentList) >= 2 {
+			var err error
+			if ms, err = call.Argument(1).ToInteger(); err != nil || ms < 0 {
+				return otto.FalseValue()
+			}
+		}
+		var args []interface{}
+		if len(call.ArgumentList) > 2 {
+			for _, arg := range call.ArgumentList[2:] {
+				args = append(args, arg)
+			}
+		}
+
+		t := &pluginTimer{
+			function: call.Argument(0),
+			args:     args,
+			network:  p.network,
+			delay:    time.Duration(ms) * time.Millisecond,
+			repeat:   repeat,
+			what:     "setTimeout job",
+		}
+		if repeat {
+			t.what = "setInterval job"
+			if t.delay < minTimerInterval {
+				t.delay = minTimerInterval
+			}
+		}
+		return p.timerValue(p.addTimer(t))
+	}
+
+	p.js.Set("setTimeout", func(call otto.FunctionCall) otto.Value {
+		return newTimer(call, false)
+	})
+	p.js.Set("setInterval", func(call otto.FunctionCall) otto.Value {
+		return newTimer(call, true)
+	})
+
+	clearJob := func(call otto.FunctionCall) otto.Value {
+		if len(call.ArgumentList) == 1 && call.ArgumentList[0].IsNumber() {
+			if id, err := call.Argument(0).ToInteger(); err == nil {
+				p.clearTimer(int(id))
+				return otto.TrueValue()
+			}
+		}
+		return otto.FalseValue()
+	}
+	p.js.Set("clearTimeout", clearJob)
+	p.js.Set("clearInterval", clearJob)
+
+	// Schedule(spec, fn), cancelled with clearTimeout
+	p.js.Set("Schedule", func(call otto.FunctionCall) otto.Value {
+		if len(call.ArgumentList) == 2 && call.ArgumentList[0].IsString() && call.ArgumentList[1].IsFunction() {
+			schedule, err := utils.ParseCron(call.Argument(0).String())
+			if err != nil {
+				p.log.Printf("Schedule errored: %s\n", err)
+				return otto.FalseValue()
+			}
+			return p.timerValue(p.addTimer(&pluginTimer{
+				function: call.Argument(1),
+				network:  p.network,
+				schedule: schedule,
+				what:     fmt.Sprintf("Scheduled job `%s`", call.Argument(0).String()),
+			}))
+		}
+		return otto.FalseValue()
+	})
+}
@@ -10,21 +10,22 @@ type pmUtilsJSBridge struct {
 	LikeTrack, HateTrack, Request func(call otto.FunctionCall) otto.Value
 }
 
-func (pm *PluginManager) InitUtilsJSBridge() {
+func (pm *PluginManager) InitUtilsJSBridge(p *Plugin) {
+	js := p.js
 	bridge := &pmUtilsJSBridge{
 		GetPage: func(call otto.FunctionCall) otto.Value {
 			var err error
 			switch {
 			case len(call.ArgumentList) == 1 && call.ArgumentList[0].IsString():
 				if page, err := utils.GetPage(call.Argument(0).String()); err == nil {
-					if val, err := pm.js.ToValue(page); err == nil {
+					if val, err := js.ToValue(page); err == nil {
 						return val
 					}
 				}
 				pm.log.Printf("[UTILS] GetPage errored: %s\n", err)
 			case len(call.ArgumentList) == 3 && call.ArgumentList[0].IsString() && call.ArgumentList[1].IsString() && call.ArgumentList[2].IsString():
 				if page, err := utils.GetPageWithAuth(call.Argument(0).String(), call.Argument(1).String(), call.Argument(2).String()); err == nil {
-					if val, err := pm.js.ToValue(page); err == nil {
+					if val, err := js.ToValue(page); err == nil {
 						return val
 					}
 				}
@@ -36,7 +37,7 @@ func (pm *PluginManager) InitUtilsJSBridge() {
 			var err error
 			if len(call.ArgumentList) == 1 && call.ArgumentList[0].IsString() {
 				if url, err := utils.ExtractURL(call.Argument(0).String()); err == nil {
-					if val, err := pm.js.ToValue(url); err == nil {
+					if val, err := js.ToValue(url); err == nil {
 						return val
 					}
 				}
@@ -48,7 +49,7 @@ func (pm *PluginManager) InitUtilsJSBridge() {
 			var err error
 			if len(call.ArgumentList) == 1 && call.ArgumentList[0].IsString() {
 				if title, err := utils.ExtractTitle(call.Argument(0).String()); err == nil {
-					if val, err := pm.js.ToValue(title); err == nil {
+					if val, err := js.ToValue(title); err == nil {
 						return val
 					}
 				}
@@ -68,5 +69,11 @@ func (pm *PluginManager) InitUtilsJSBridge() {
 			return otto.FalseValue()
 		},
 	}
-	pm.js.Set("UTILS", bridge)
+
+	// Fetching pages needs the network capability
+	if !p.granted(CapNetwork) {
+		bridge.GetPage = p.denied("UTILS.GetPage", CapNetwork)
+		bridge.ExtractTitle = p.denied("UTILS.ExtractTitle", CapNetwork)
+	}
+	js.Set("UTILS", bridge)
 }
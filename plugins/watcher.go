@@ -0,0 +1,238 @@
+package plugins
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/fsnotify/fsnotify"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a plugin file has to stay untouched before being reloaded, as
+// editors often write a file in several steps
+const watchDebounce = 500 * time.Millisecond
+
+// How often the plugin directory is scanned when inotify isn't available
+const watchPollInterval = 2 * time.Second
+
+// Reloads plugins whose files change in the plugin directory
+type pluginWatcher struct {
+	pm *PluginManager
+
+	// Pending reloads, per plugin file
+	pending map[string]*time.Timer
+	mutex   sync.Mutex
+}
+
+// Starts watching the plugin directory, reloading only the plugins whose
+// file, or sidecar manifest, changed. Plugins failing to run keep their
+// loaded version.
+func (pm *PluginManager) WatchPlugins() {
+	w := &pluginWatcher{
+		pm:      pm,
+		pending: make(map[string]*time.Timer),
+	}
+
+	watcher, err := w.inotify()
+	if err != nil {
+		pm.log.Printf("Couldn't watch the plugin directory, scanning it every %s instead: %s\n", watchPollInterval, err)
+		go w.poll()
+		return
+	}
+	go w.watch(watcher)
+}
+
+// Sets up inotify on the plugin directory and its subdirectories
+func (w *pluginWatcher) inotify() (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	err = filepath.Walk(w.pm.cfg.Irc.PluginsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			// Skip hidden folders, like the plugin history
+			if path != w.pm.cfg.Irc.PluginsDir && filepath.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return watcher.Add(path)
+		}
+		return nil
+	})
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	return watcher, nil
+}
+
+// Adds a new directory and its subdirectories to the watcher
+func (w *pluginWatcher) watchDir(watcher *fsnotify.Watcher, path string) {
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		return
+	}
+	err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case !info.IsDir():
+			// Plugins written before the directory was watched
+			w.changed(path)
+		case filepath.HasPrefix(info.Name(), "."):
+			return filepath.SkipDir
+		default:
+			return watcher.Add(path)
+		}
+		return nil
+	})
+	if err != nil {
+		w.pm.log.Printf("Couldn't watch plugin directory `%s`: %s\n", path, err)
+	}
+}
+
+func (w *pluginWatcher) watch(watcher *fsnotify.Watcher) {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			// Watch directories created after startup too
+			if event.Op&fsnotify.Create != 0 {
+				w.watchDir(watcher, event.Name)
+			}
+			w.changed(event.Name)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			w.pm.log.Printf("Error watching the plugin directory: %s\n", err)
+		}
+	}
+}
+
+// Compares the plugin files' modification times and sizes every
+// watchPollInterval
+func (w *pluginWatcher) poll() {
+	type stamp struct {
+		modified time.Time
+		size     int64
+	}
+	scan := func() map[string]stamp {
+		stamps := make(map[string]stamp)
+		filepath.Walk(w.pm.cfg.Irc.PluginsDir, func(path string, info os.FileInfo, err error) error {
+			switch {
+			case err != nil:
+			case info.IsDir() && path != w.pm.cfg.Irc.PluginsDir && filepath.HasPrefix(info.Name(), "."):
+				return filepath.SkipDir
+			case info.Mode().IsRegular():
+				stamps[path] = stamp{info.ModTime(), info.Size()}
+			}
+			return nil
+		})
+		return stamps
+	}
+
+	previous := scan()
+	for range time.Tick(watchPollInterval) {
+		current := scan()
+		for path, s := range current {
+			if old, ok := previous[path]; !ok || old != s {
+				w.changed(path)
+			}
+		}
+		for path := range previous {
+			if _, ok := current[path]; !ok {
+				w.changed(path)
+			}
+		}
+		previous = current
+	}
+}
+
+// Schedules the reload of the plugin a changed file belongs to, putting
+// it off while the file keeps changing
+func (w *pluginWatcher) changed(path string) {
+	name := filepath.Base(path)
+	if filepath.HasPrefix(name, ".") {
+		return
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".js":
+	case ".json":
+		// Sidecar manifest
+		path = strings.TrimSuffix(path, filepath.Ext(path)) + ".js"
+	default:
+		return
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if timer, ok := w.pending[path]; ok {
+		timer.Reset(watchDebounce)
+		return
+	}
+	w.pending[path] = time.AfterFunc(watchDebounce, func() {
+		w.mutex.Lock()
+		delete(w.pending, path)
+		w.mutex.Unlock()
+		w.reload(path)
+	})
+}
+
+// Returns the sha256 of a plugin's code and sidecar manifest, to tell
+// whether its files changed since it was loaded
+func pluginHash(path string, code []byte) string {
+	hash := sha256.New()
+	hash.Write(code)
+	if manifest, err := ioutil.ReadFile(strings.TrimSuffix(path, filepath.Ext(path)) + ".json"); err == nil {
+		hash.Write(manifest)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Reloads the plugin at path, or unloads it when its file is gone
+func (w *pluginWatcher) reload(path string) {
+	pm := w.pm
+	name := filepath.Base(path)
+
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	code, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		if plugin, ok := pm.plugins[name]; ok && plugin.path == path {
+			plugin.stop()
+			delete(pm.plugins, name)
+			pm.log.Printf("Unloaded plugin `%s`, its file was removed\n", name)
+		}
+		return
+	}
+
+	// Plugins unloaded by hand stay unloaded until loaded by hand
+	if pm.unloaded[name] {
+		return
+	}
+
+	// Files written by !import or a rollback were loaded already
+	if plugin, ok := pm.plugins[name]; ok && err == nil && plugin.path == path && plugin.hash == pluginHash(path, code) {
+		return
+	}
+
+	if err := pm.loadPlugin(path); err != nil {
+		if _, ok := pm.plugins[name]; ok {
+			pm.alertStaff("ALERT: couldn't reload plugin " + name + ", keeping the loaded version: " + err.Error())
+		} else {
+			pm.alertStaff("ALERT: couldn't load plugin " + name + ": " + err.Error())
+		}
+		return
+	}
+	pm.log.Printf("Reloaded plugin `%s` after its file changed\n", name)
+}
@@ -0,0 +1,62 @@
+package plugins
+
+import (
+	"github.com/thoj/go-ircevent"
+)
+
+// Max events waiting for a plugin before new ones get dropped
+const maxPluginQueue = 100
+
+// Event waiting for a plugin's worker, either for its callbacks, for one
+// of its commands or a timer that is due
+type pluginEvent struct {
+	network *Network
+	event   *irc.Event
+	command bool
+	timer   *pluginTimer
+}
+
+// Starts the worker handing events to the plugin, one at a time and in
+// the order they came in
+func (p *Plugin) start() {
+	go p.work()
+}
+
+// Stops the worker and timers, dropping the events still waiting
+func (p *Plugin) stop() {
+	p.stopTimers()
+	close(p.quit)
+}
+
+func (p *Plugin) work() {
+	for {
+		select {
+		case <-p.quit:
+			return
+		case e := <-p.events:
+			switch {
+			case e.timer != nil:
+				p.runTimer(e.timer)
+			case e.command:
+				p.RunCommand(e.network, e.event)
+			default:
+				p.RunCallbacks(e.network, e.event)
+			}
+		}
+	}
+}
+
+// Queues an event for the worker, dropping it when the queue is full so a
+// slow plugin can't hold up the others
+func (p *Plugin) enqueue(network *Network, event *irc.Event, command bool) {
+	select {
+	case p.events <- pluginEvent{network: network, event: event, command: command}:
+	default:
+		p.log.Printf("Event queue full, dropping `%s` event from `%s`\n", event.Code, network.Name)
+	}
+}
+
+// Returns the number of events waiting for the worker
+func (p *Plugin) QueueDepth() int {
+	return len(p.events)
+}
@@ -0,0 +1,259 @@
+package queue
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thoj/go-ircevent"
+)
+
+// Send priority lanes, drained highest first
+const (
+	High   = iota // Keepalive and registration: PONG, PING, CAP, AUTHENTICATE, NICK, QUIT
+	Normal        // Channel and server control: JOIN, PART, MODE, WHO, ...
+	Low           // Chat output: PRIVMSG, NOTICE
+	lanes
+)
+
+// Max lines waiting in a lane before new ones get dropped
+const maxLaneDepth = 1000
+
+// How often the connection is checked while lines are held back for it
+const reconnectPoll = time.Second
+
+var laneNames = [lanes]string{"high", "normal", "low"}
+
+// Token bucket throttled queue for every line sent to the server, so the
+// bot can't get itself killed for excess flood
+type Queue struct {
+	conn  *irc.Connection
+	lanes [lanes][]string
+	mutex sync.Mutex
+	wake  chan bool
+	log   *log.Logger
+
+	// Returns the nick!user@host the server prefixes our messages with
+	source func() string
+
+	// Lines allowed in a burst, and lines per second after that (0 for
+	// no limit)
+	burst int
+	rate  float64
+}
+
+func New(conn *irc.Connection, burst int, rate float64) *Queue {
+	if burst < 1 {
+		burst = 1
+	}
+	q := &Queue{
+		conn:  conn,
+		wake:  make(chan bool, 1),
+		log:   log.New(os.Stdout, "[queue] ", log.LstdFlags),
+		burst: burst,
+		rate:  rate,
+	}
+	go q.run()
+	return q
+}
+
+// Returns the lane a line is sent through, based on its command
+func priority(line string) int {
+	command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+	switch command {
+	case "PONG", "PING", "CAP", "AUTHENTICATE", "NICK", "QUIT", "PASS", "USER":
+		return High
+	case "PRIVMSG", "NOTICE":
+		return Low
+	}
+	return Normal
+}
+
+// Queues a raw line
+func (q *Queue) SendRaw(line string) {
+	lane := priority(line)
+
+	q.mutex.Lock()
+	if len(q.lanes[lane]) >= maxLaneDepth {
+		q.mutex.Unlock()
+		q.log.Printf("Dropping line, %s priority lane is full: %s", laneNames[lane], line)
+		return
+	}
+	q.lanes[lane] = append(q.lanes[lane], line)
+	q.mutex.Unlock()
+
+	// Wake the sender if it is waiting for lines
+	select {
+	case q.wake <- true:
+	default:
+	}
+}
+
+// Queues a formatted raw line
+func (q *Queue) SendRawf(format string, a ...interface{}) {
+	q.SendRaw(fmt.Sprintf(format, a...))
+}
+
+// Sets the function returning the bot's own nick!user@host, used to work
+// out how long messages can be
+func (q *Queue) SetSource(source func() string) {
+	q.source = source
+}
+
+// Queues a message, split over as many lines as needed
+func (q *Queue) Privmsg(target, message string) {
+	q.message("PRIVMSG", target, message)
+}
+
+// Queues a notice, split over as many lines as needed
+func (q *Queue) Notice(target, message string) {
+	q.message("NOTICE", target, message)
+}
+
+func (q *Queue) message(command, target, message string) {
+	// Room left once the server added our prefix and the CRLF
+	source := "*"
+	if q.source != nil {
+		source = q.source()
+	}
+	budget := maxLine - len(fmt.Sprintf(":%s %s %s :\r\n", source, command, target))
+
+	for _, line := range strings.Split(strings.Replace(message, "\r", "", -1), "\n") {
+		// Keep the CTCP framing around every part, e.g. for ACTIONs
+		head, tail := "", ""
+		if len(line) > 2 && line[0] == '\x01' && line[len(line)-1] == '\x01' {
+			line = line[1 : len(line)-1]
+			head, tail = "\x01", "\x01"
+			if idx := strings.Index(line, " "); idx != -1 {
+				head, line = head+line[:idx+1], line[idx+1:]
+			}
+		}
+
+		for _, part := range SplitMessage(line, budget-len(head)-len(tail)) {
+			q.SendRawf("%s %s :%s%s%s", command, target, head, part, tail)
+		}
+	}
+}
+
+func (q *Queue) Nick(nick string) {
+	q.SendRawf("NICK %s", nick)
+}
+
+func (q *Queue) Join(channel string, key ...string) {
+	if len(key) > 0 && key[0] != "" {
+		q.SendRawf("JOIN %s %s", channel, key[0])
+		return
+	}
+	q.SendRawf("JOIN %s", channel)
+}
+
+func (q *Queue) Part(channel string) {
+	q.SendRawf("PART %s", channel)
+}
+
+func (q *Queue) Who(target string) {
+	q.SendRawf("WHO %s", target)
+}
+
+func (q *Queue) Whois(nick string) {
+	q.SendRawf("WHOIS %s", nick)
+}
+
+func (q *Queue) Mode(target string, modestring ...string) {
+	mode := strings.Join(modestring, " ")
+	if mode != "" {
+		mode = " " + mode
+	}
+	q.SendRawf("MODE %s%s", target, mode)
+}
+
+// Drops every queued line, used when the connection is reset
+func (q *Queue) Clear() {
+	q.mutex.Lock()
+	for lane := range q.lanes {
+		q.lanes[lane] = nil
+	}
+	q.mutex.Unlock()
+}
+
+// Returns the number of lines waiting in each lane
+func (q *Queue) Depths() map[string]int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	depths := make(map[string]int, lanes)
+	for lane, lines := range q.lanes {
+		depths[laneNames[lane]] = len(lines)
+	}
+	return depths
+}
+
+// Returns the total number of lines waiting
+func (q *Queue) Depth() (depth int) {
+	q.mutex.Lock()
+	for _, lines := range q.lanes {
+		depth += len(lines)
+	}
+	q.mutex.Unlock()
+	return
+}
+
+// Pops the next line from the highest priority lane holding one
+func (q *Queue) next() (string, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for lane, lines := range q.lanes {
+		if len(lines) > 0 {
+			q.lanes[lane] = lines[1:]
+			return lines[0], true
+		}
+	}
+	return "", false
+}
+
+// Sends queued lines as tokens become available
+func (q *Queue) run() {
+	tokens := float64(q.burst)
+	last := time.Now()
+
+	for {
+		// Wait for something to send
+		if q.Depth() == 0 {
+			<-q.wake
+			continue
+		}
+
+		// Hold lines back while disconnected, as sending would block
+		// until the connection is back
+		if !q.conn.Connected() {
+			time.Sleep(reconnectPoll)
+			continue
+		}
+
+		if q.rate > 0 {
+			// Refill the bucket, waiting for a whole token if need be
+			now := time.Now()
+			tokens += now.Sub(last).Seconds() * q.rate
+			if tokens > float64(q.burst) {
+				tokens = float64(q.burst)
+			}
+			last = now
+
+			if tokens < 1 {
+				time.Sleep(time.Duration((1 - tokens) / q.rate * float64(time.Second)))
+				continue
+			}
+			tokens--
+		}
+
+		// Pick the line only once we can send it, so lines queued while
+		// waiting can still skip ahead
+		if line, ok := q.next(); ok {
+			q.conn.SendRaw(line)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package queue
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Longest line the server accepts, CRLF included
+const maxLine = 512
+
+// Appended to every part of a split message but the last
+const continuation = " …"
+
+// Toggle formatting codes: bold, monospace, reverse, italic, strikethrough
+// and underline
+const toggleCodes = "\x02\x11\x16\x1d\x1e\x1f"
+
+// Formatting in effect at some point of a message, re-applied at the start
+// of continued parts
+type format struct {
+	toggles map[byte]bool
+	color   string // Last \x03 or \x04 code, "" when reset
+}
+
+// Tracks the formatting codes found in s
+func (f *format) apply(s string) {
+	if f.toggles == nil {
+		f.toggles = make(map[byte]bool)
+	}
+	for i := 0; i < len(s); {
+		code := formatCode(s[i:])
+		if code == "" {
+			i++
+			continue
+		}
+		switch {
+		case code == "\x0f":
+			f.toggles = make(map[byte]bool)
+			f.color = ""
+		case code[0] == '\x03' || code[0] == '\x04':
+			if len(code) == 1 {
+				f.color = ""
+			} else {
+				f.color = code
+			}
+		default:
+			f.toggles[code[0]] = !f.toggles[code[0]]
+		}
+		i += len(code)
+	}
+}
+
+// Returns the codes that turn the formatting back on
+func (f *format) codes() string {
+	var codes []byte
+	for i := 0; i < len(toggleCodes); i++ {
+		if f.toggles[toggleCodes[i]] {
+			codes = append(codes, toggleCodes[i])
+		}
+	}
+	return string(codes) + f.color
+}
+
+// Returns the formatting code s starts with, "" when it doesn't start
+// with one
+func formatCode(s string) string {
+	if s == "" {
+		return ""
+	}
+	switch {
+	case s[0] == '\x0f' || strings.IndexByte(toggleCodes, s[0]) != -1:
+		return s[:1]
+	case s[0] == '\x03':
+		// \x03[fg[,bg]], colors being one or two digits
+		n := 1 + countDigits(s[1:], "0123456789", 2)
+		if n > 1 && n < len(s) && s[n] == ',' {
+			if bg := countDigits(s[n+1:], "0123456789", 2); bg > 0 {
+				n += 1 + bg
+			}
+		}
+		return s[:n]
+	case s[0] == '\x04':
+		// \x04[RRGGBB[,RRGGBB]]
+		const hex = "0123456789abcdefABCDEF"
+		n := 1
+		if countDigits(s[1:], hex, 6) == 6 {
+			n += 6
+			if n < len(s) && s[n] == ',' && countDigits(s[n+1:], hex, 6) == 6 {
+				n += 7
+			}
+		}
+		return s[:n]
+	}
+	return ""
+}
+
+// Returns how many of the first max bytes of s are in digits
+func countDigits(s, digits string, max int) (n int) {
+	for n < max && n < len(s) && strings.IndexByte(digits, s[n]) != -1 {
+		n++
+	}
+	return
+}
+
+// Returns where to cut s so its head fits in room bytes, preferring the
+// last space, and where the rest starts. Runes and formatting codes are
+// never cut in half.
+func splitPoint(s string, room int) (cut, next int) {
+	lastSpace := -1
+	i := 0
+	for i < len(s) {
+		size := len(formatCode(s[i:]))
+		if size == 0 {
+			_, size = utf8.DecodeRuneInString(s[i:])
+		}
+		if i+size > room {
+			break
+		}
+		if s[i] == ' ' && i > 0 {
+			lastSpace = i
+		}
+		i += size
+	}
+
+	switch {
+	case lastSpace > 0:
+		return lastSpace, lastSpace + 1
+	case i == 0:
+		// Not even one rune fits, send it anyway rather than loop forever
+		_, size := utf8.DecodeRuneInString(s)
+		return size, size
+	}
+	return i, i
+}
+
+// Splits a message into parts of at most budget bytes, on word boundaries
+// where possible. Every part but the last ends with a continuation marker,
+// and formatting still in effect is carried over to the next part. Empty
+// messages have no parts, as servers refuse to send them.
+func SplitMessage(message string, budget int) []string {
+	parts := make([]string, 0, 1)
+	var active format
+	for message != "" {
+		prefix := active.codes()
+		if len(prefix)+len(message) <= budget {
+			return append(parts, prefix+message)
+		}
+
+		cut, next := splitPoint(message, budget-len(continuation)-len(prefix))
+		parts = append(parts, prefix+message[:cut]+continuation)
+		active.apply(message[:cut])
+		message = message[next:]
+	}
+	return parts
+}
@@ -0,0 +1,71 @@
+package queue
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		budget  int
+		want    []string
+	}{
+		{"empty", "", 20, []string{}},
+		{"fits", "hello world", 20, []string{"hello world"}},
+		{"exact fit", "hello", 5, []string{"hello"}},
+		{"word boundary", "aaaa bbbb cccc", 10, []string{"aaaa …", "bbbb cccc"}},
+		{"no space", "abcdefghij", 8, []string{"abcd …", "efghij"}},
+		{"multibyte at boundary", "ééééé", 9, []string{"éé …", "ééé"}},
+		{"rune wider than the room", "日本", 5, []string{"日 …", "本"}},
+		{"colour carried over", "\x0304red red red", 12, []string{"\x0304red …", "\x0304red red"}},
+		{"colour with background", "\x0304,12ab cd ef", 13, []string{"\x0304,12ab …", "\x0304,12cd ef"}},
+		{"hex colour carried over", "\x04ff0000ab cd ef", 14, []string{"\x04ff0000ab …", "\x04ff0000cd ef"}},
+		{"colour reset", "\x0304ab\x03 cd ef gh", 12, []string{"\x0304ab\x03 …", "cd ef gh"}},
+		{"bold carried over", "\x02bold words here", 13, []string{"\x02bold …", "\x02words here"}},
+		{"bold turned off", "\x02bold\x02 plain words", 16, []string{"\x02bold\x02 …", "plain words"}},
+		{"formatting reset", "\x02\x0304ab\x0f cd ef gh", 14, []string{"\x02\x0304ab\x0f …", "cd ef gh"}},
+		{"code not cut in half", "ab\x0304cdef", 8, []string{"ab …", "\x0304cdef"}},
+	}
+
+	for _, test := range tests {
+		got := SplitMessage(test.message, test.budget)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: SplitMessage(%q, %d) = %q, want %q", test.name, test.message, test.budget, got, test.want)
+		}
+		for _, part := range got {
+			if len(part) > test.budget && utf8.RuneCountInString(strings.TrimSuffix(part, continuation)) > 1 {
+				t.Errorf("%s: part %q is longer than %d bytes", test.name, part, test.budget)
+			}
+			if !utf8.ValidString(part) {
+				t.Errorf("%s: part %q isn't valid UTF-8", test.name, part)
+			}
+		}
+	}
+}
+
+func TestMessageLines(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    []string
+	}{
+		{"one line", "hello", []string{"PRIVMSG #c :hello"}},
+		{"several lines", "hello\r\nworld", []string{"PRIVMSG #c :hello", "PRIVMSG #c :world"}},
+		{"empty", "", nil},
+		{"trailing newline", "hello\n", []string{"PRIVMSG #c :hello"}},
+		{"blank lines", "\n\nhello\n\n", []string{"PRIVMSG #c :hello"}},
+		{"action", "\x01ACTION waves\x01", []string{"PRIVMSG #c :\x01ACTION waves\x01"}},
+	}
+
+	for _, test := range tests {
+		q := &Queue{wake: make(chan bool, 1)}
+		q.Privmsg("#c", test.message)
+		if got := q.lanes[Low]; !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: Privmsg(%q) queued %q, want %q", test.name, test.message, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package state
+
+import (
+	"sort"
+	"sync"
+)
+
+// Set of IRCv3 capabilities acknowledged by the server, along with any
+// value the server advertised for them (e.g. sasl=PLAIN,EXTERNAL)
+type Capabilities struct {
+	caps  map[string]string
+	mutex sync.RWMutex
+}
+
+func NewCapabilities() *Capabilities {
+	return &Capabilities{caps: make(map[string]string)}
+}
+
+// Marks a capability as enabled
+func (c *Capabilities) Enable(name, value string) {
+	c.mutex.Lock()
+	c.caps[name] = value
+	c.mutex.Unlock()
+}
+
+// Marks a capability as no longer enabled
+func (c *Capabilities) Disable(name string) {
+	c.mutex.Lock()
+	delete(c.caps, name)
+	c.mutex.Unlock()
+}
+
+// Forgets every capability, used when the connection is reset
+func (c *Capabilities) Clear() {
+	c.mutex.Lock()
+	c.caps = make(map[string]string)
+	c.mutex.Unlock()
+}
+
+// Whether the capability is enabled
+func (c *Capabilities) Has(name string) (ok bool) {
+	c.mutex.RLock()
+	_, ok = c.caps[name]
+	c.mutex.RUnlock()
+	return
+}
+
+// Returns the value advertised for an enabled capability
+func (c *Capabilities) Value(name string) (value string, ok bool) {
+	c.mutex.RLock()
+	value, ok = c.caps[name]
+	c.mutex.RUnlock()
+	return
+}
+
+// Return sorted string slice of enabled capabilities
+func (c *Capabilities) List() (caps []string) {
+	c.mutex.RLock()
+	caps = make([]string, 0, len(c.caps))
+	for name, _ := range c.caps {
+		caps = append(caps, name)
+	}
+	c.mutex.RUnlock()
+	sort.Strings(caps)
+	return
+}
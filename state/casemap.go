@@ -0,0 +1,82 @@
+package state
+
+// Folds a nick or channel name to lower case according to the server's
+// CASEMAPPING, so names differing only in case map to the same key
+func FoldCase(casemapping, name string) string {
+	folded := []byte(name)
+	for i, c := range folded {
+		switch {
+		case c >= 'A' && c <= 'Z':
+			folded[i] = c + ('a' - 'A')
+		case casemapping == "ascii":
+			// Only A-Z are folded
+		case c == '[' || c == ']' || c == '\\':
+			// {}| are the lower case forms of []\
+			folded[i] = c + ('{' - '[')
+		case c == '^' && casemapping != "strict-rfc1459":
+			// ~ is the lower case form of ^ in rfc1459
+			folded[i] = '~'
+		}
+	}
+	return string(folded)
+}
+
+// Folds a name using the current server casemapping
+func (st *StateTracker) fold(name string) string {
+	return FoldCase(st.info.CaseMapping, name)
+}
+
+// Folds a name using the current server casemapping, for keys of maps
+// kept outside of the state tracker
+func (st *StateTracker) FoldCase(name string) string {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	return st.fold(name)
+}
+
+// Whether two nicks or channel names are the same, ignoring case
+func (st *StateTracker) EqualFold(a, b string) bool {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	return st.fold(a) == st.fold(b)
+}
+
+// Rebuilds every map key after the casemapping changed
+func (st *StateTracker) rekey() {
+	nickKeys := make(map[string]string, len(st.nicks))
+	nicks := make(map[string]*Nick, len(st.nicks))
+	for key, nick := range st.nicks {
+		nickKeys[key] = st.fold(nick.Nick)
+		nicks[nickKeys[key]] = nick
+	}
+
+	channelKeys := make(map[string]string, len(st.channels))
+	channels := make(map[string]*Channel, len(st.channels))
+	for key, channel := range st.channels {
+		channelKeys[key] = st.fold(channel.Name)
+		channels[channelKeys[key]] = channel
+	}
+
+	for _, channel := range channels {
+		members := make(map[string]*ChannelPrivileges, len(channel.Nicks))
+		for key, privs := range channel.Nicks {
+			if newKey, ok := nickKeys[key]; ok {
+				members[newKey] = privs
+			}
+		}
+		channel.Nicks = members
+	}
+
+	for _, nick := range nicks {
+		joined := make(map[string]*ChannelPrivileges, len(nick.Channels))
+		for key, privs := range nick.Channels {
+			if newKey, ok := channelKeys[key]; ok {
+				joined[newKey] = privs
+			}
+		}
+		nick.Channels = joined
+	}
+
+	st.nicks = nicks
+	st.channels = channels
+}
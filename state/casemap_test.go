@@ -0,0 +1,24 @@
+package state
+
+import "testing"
+
+func TestFoldCase(t *testing.T) {
+	tests := []struct {
+		casemapping, name, want string
+	}{
+		{"ascii", "Nick[A]", "nick[a]"},
+		{"ascii", `x^~\|`, `x^~\|`},
+		{"rfc1459", "Nick[A]", "nick{a}"},
+		{"rfc1459", `[]\^`, "{}|~"},
+		{"rfc1459", "{}|~", "{}|~"},
+		{"strict-rfc1459", `[]\^`, "{}|^"},
+		{"strict-rfc1459", "~", "~"},
+		{"rfc1459", "#Chan-Ä", "#chan-Ä"},
+	}
+
+	for _, test := range tests {
+		if got := FoldCase(test.casemapping, test.name); got != test.want {
+			t.Errorf("FoldCase(%q, %q) = %q, want %q", test.casemapping, test.name, got, test.want)
+		}
+	}
+}
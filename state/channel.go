@@ -2,8 +2,17 @@ package state
 
 import (
 	"strconv"
+	"strings"
+	"time"
 )
 
+// Entry in one of the channel's ban, exception, invite exception or
+// quiet lists
+type ListEntry struct {
+	Mask, SetBy string
+	SetAt       time.Time
+}
+
 type ChannelModes struct {
 	// MODE +p, +s, +t, +n, +m
 	Private, Secret, ProtectedTopic, NoExternalMsg, Moderated bool
@@ -19,6 +28,60 @@ type ChannelModes struct {
 
 	// MODE +l
 	Limit int
+
+	// MODE +b, +e, +I, +q (when q is a list mode rather than a prefix)
+	Bans, Excepts, InviteExcepts, Quiets []ListEntry
+}
+
+// Returns the list stored for a list mode
+func (modes *ChannelModes) list(mode byte) *[]ListEntry {
+	switch mode {
+	case 'b':
+		return &modes.Bans
+	case 'e':
+		return &modes.Excepts
+	case 'I':
+		return &modes.InviteExcepts
+	case 'q':
+		return &modes.Quiets
+	}
+	return nil
+}
+
+// Returns the field stored for a flag mode
+func (modes *ChannelModes) flag(mode byte) *bool {
+	switch mode {
+	case 'i':
+		return &modes.InviteOnly
+	case 'm':
+		return &modes.Moderated
+	case 'n':
+		return &modes.NoExternalMsg
+	case 'p':
+		return &modes.Private
+	case 'r':
+		return &modes.Registered
+	case 's':
+		return &modes.Secret
+	case 't':
+		return &modes.ProtectedTopic
+	case 'z':
+		return &modes.SSLOnly
+	case 'Z':
+		return &modes.AllSSL
+	case 'O':
+		return &modes.OperOnly
+	}
+	return nil
+}
+
+// Returns a copy of the modes that shares no list storage
+func (modes ChannelModes) Copy() ChannelModes {
+	for _, mode := range []byte("beIq") {
+		list := modes.list(mode)
+		*list = append([]ListEntry(nil), *list...)
+	}
+	return modes
 }
 
 type ChannelPrivileges struct {
@@ -26,76 +89,159 @@ type ChannelPrivileges struct {
 	Owner, Admin, Op, HalfOp, Voice bool
 }
 
+// Whether the privilege matching a privilege mode is held
+func (privs *ChannelPrivileges) hasMode(mode byte) bool {
+	switch mode {
+	case 'q':
+		return privs.Owner
+	case 'a':
+		return privs.Admin
+	case 'o':
+		return privs.Op
+	case 'h':
+		return privs.HalfOp
+	case 'v':
+		return privs.Voice
+	}
+	return false
+}
+
+// Sets the privilege matching a privilege mode
+func (privs *ChannelPrivileges) setMode(mode byte, set bool) {
+	switch mode {
+	case 'q':
+		privs.Owner = set
+	case 'a':
+		privs.Admin = set
+	case 'o':
+		privs.Op = set
+	case 'h':
+		privs.HalfOp = set
+	case 'v':
+		privs.Voice = set
+	}
+}
+
 type Channel struct {
 	Name, Topic string
 	Modes       ChannelModes
-	Nicks       map[string]*ChannelPrivileges
+	Nicks       map[string]*ChannelPrivileges // Keyed by case folded nick
+
+	fold func(string) string
+
+	// Lists being received from the server, swapped in once complete
+	pendingLists map[byte][]ListEntry
+}
+
+// Adds an entry to a list mode, replacing an existing entry for the mask
+func (channel *Channel) addListEntry(mode byte, entry ListEntry) {
+	if list := channel.Modes.list(mode); list != nil {
+		channel.removeListEntry(mode, entry.Mask)
+		*list = append(*list, entry)
+	}
+}
+
+// Whether a list mode holds an entry for the mask
+func (channel *Channel) hasListEntry(mode byte, mask string) bool {
+	if list := channel.Modes.list(mode); list != nil {
+		for _, entry := range *list {
+			if channel.fold(entry.Mask) == channel.fold(mask) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Removes the entry for a mask from a list mode
+func (channel *Channel) removeListEntry(mode byte, mask string) {
+	if list := channel.Modes.list(mode); list != nil {
+		for i, entry := range *list {
+			if channel.fold(entry.Mask) == channel.fold(mask) {
+				*list = append((*list)[:i], (*list)[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Collects an entry from a list reply (367, 348, 346, 728)
+func (channel *Channel) receiveListEntry(mode byte, entry ListEntry) {
+	if channel.pendingLists == nil {
+		channel.pendingLists = make(map[byte][]ListEntry)
+	}
+	channel.pendingLists[mode] = append(channel.pendingLists[mode], entry)
+}
+
+// Replaces a list once its end of list reply arrives (368, 349, 347, 729)
+func (channel *Channel) endList(mode byte) {
+	if list := channel.Modes.list(mode); list != nil {
+		*list = channel.pendingLists[mode]
+	}
+	delete(channel.pendingLists, mode)
 }
 
-func (channel *Channel) ParseModes(modes string, modeargs ...string) {
+// Applies a mode change made by setBy, using the server info to work out
+// which modes consume an argument
+func (channel *Channel) ParseModes(info *ServerInfo, setBy, modes string, modeargs ...string) {
 	var modeop bool // true => add mode, false => remove mode
 	for i := 0; i < len(modes); i++ {
-		switch m := modes[i]; m {
-		case '+':
-			modeop = true
-		case '-':
-			modeop = false
-		case 'i':
-			channel.Modes.InviteOnly = modeop
-		case 'm':
-			channel.Modes.Moderated = modeop
-		case 'n':
-			channel.Modes.NoExternalMsg = modeop
-		case 'p':
-			channel.Modes.Private = modeop
-		case 'r':
-			channel.Modes.Registered = modeop
-		case 's':
-			channel.Modes.Secret = modeop
-		case 't':
-			channel.Modes.ProtectedTopic = modeop
-		case 'z':
-			channel.Modes.SSLOnly = modeop
-		case 'Z':
-			channel.Modes.AllSSL = modeop
-		case 'O':
-			channel.Modes.OperOnly = modeop
+		m := modes[i]
+		if m == '+' || m == '-' {
+			modeop = m == '+'
+			continue
+		}
+
+		// Take the mode argument if this mode uses one
+		var arg string
+		hasArg := info.ModeTakesArg(m, modeop)
+		if hasArg && len(modeargs) != 0 {
+			arg, modeargs = modeargs[0], modeargs[1:]
+		} else if hasArg {
+			continue
+		}
+
+		// Privilege modes apply to the nick given as argument
+		if strings.IndexByte(info.PrefixModes, m) != -1 {
+			if privs, ok := channel.Nicks[channel.fold(arg)]; ok {
+				privs.setMode(m, modeop)
+			}
+			continue
+		}
+
+		// List modes add or remove the mask given as argument
+		if strings.IndexByte(info.ListModes, m) != -1 {
+			if modeop {
+				channel.addListEntry(m, ListEntry{Mask: arg, SetBy: setBy, SetAt: time.Now()})
+			} else {
+				channel.removeListEntry(m, arg)
+			}
+			continue
+		}
+
+		if flag := channel.Modes.flag(m); flag != nil {
+			*flag = modeop
+			continue
+		}
+
+		switch m {
 		case 'k':
-			if modeop && len(modeargs) != 0 {
-				channel.Modes.Key, modeargs = modeargs[0], modeargs[1:]
-			} else if !modeop {
+			if modeop {
+				channel.Modes.Key = arg
+			} else {
 				channel.Modes.Key = ""
 			}
 		case 'l':
-			if modeop && len(modeargs) != 0 {
-				channel.Modes.Limit, _ = strconv.Atoi(modeargs[0])
-				modeargs = modeargs[1:]
-			} else if !modeop {
+			if modeop {
+				channel.Modes.Limit, _ = strconv.Atoi(arg)
+			} else {
 				channel.Modes.Limit = 0
 			}
-		case 'q', 'a', 'o', 'h', 'v':
-			if len(modeargs) != 0 {
-				if privs, ok := channel.Nicks[modeargs[0]]; ok {
-					switch m {
-					case 'q':
-						privs.Owner = modeop
-					case 'a':
-						privs.Admin = modeop
-					case 'o':
-						privs.Op = modeop
-					case 'h':
-						privs.HalfOp = modeop
-					case 'v':
-						privs.Voice = modeop
-					}
-					modeargs = modeargs[1:]
-				}
-			}
 		}
 	}
 }
 
 func (channel *Channel) HasNick(nick string) (hasNick bool) {
-	_, hasNick = channel.Nicks[nick]
+	_, hasNick = channel.Nicks[channel.fold(nick)]
 	return
 }
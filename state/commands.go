@@ -0,0 +1,94 @@
+package state
+
+import (
+	"github.com/thoj/go-ircevent"
+	"strings"
+)
+
+// A command given to the bot, by builtins and plugins alike
+type Command struct {
+	Name   string   // Command name, without its prefix
+	Prefix string   // Prefix used, empty when addressed by nick or in private
+	Text   string   // What follows the command name
+	Args   []string // Text split on spaces
+}
+
+// Returns the command a PRIVMSG gives the bot, if any. Commands start with
+// one of the channel's prefixes (Irc.CommandPrefix unless the channel has
+// its own), or are addressed to the bot as `Nick: command`. Private
+// messages need neither.
+func (st *StateTracker) ParseCommand(event *irc.Event) (Command, bool) {
+	if event.Code != "PRIVMSG" || len(event.Arguments) == 0 {
+		return Command{}, false
+	}
+	target := event.Arguments[0]
+	message := strings.TrimSpace(event.Message())
+	if strings.HasPrefix(message, "\x01") {
+		// CTCP
+		return Command{}, false
+	}
+
+	prefixes := st.CommandPrefixes(target)
+	addressed := !st.ServerInfo().IsChannel(target)
+	if rest, ok := st.addressed(message); ok {
+		message, addressed = rest, true
+	}
+
+	// Go for the longest prefix, in case one starts another
+	var cmd Command
+	for _, prefix := range prefixes {
+		if prefix != "" && strings.HasPrefix(message, prefix) && len(prefix) > len(cmd.Prefix) {
+			cmd.Prefix = prefix
+		}
+	}
+	if cmd.Prefix == "" && !addressed {
+		return Command{}, false
+	}
+	message = strings.TrimPrefix(message, cmd.Prefix)
+
+	fields := strings.SplitN(message, " ", 2)
+	if cmd.Name = fields[0]; cmd.Name == "" {
+		return Command{}, false
+	}
+	if len(fields) == 2 {
+		cmd.Text = strings.TrimSpace(fields[1])
+	}
+	cmd.Args = strings.Fields(cmd.Text)
+	return cmd, true
+}
+
+// Returns the prefixes commands start with in target, the channel's own
+// when it has some
+func (st *StateTracker) CommandPrefixes(target string) []string {
+	if settings, ok := st.ChannelConfig(target); ok && len(settings.Prefix) > 0 {
+		return settings.Prefix
+	}
+	return st.cfg.Irc.CommandPrefix
+}
+
+// Returns the prefix to show in replies about a command given in target,
+// the one it was given with or else the first one configured there
+func (st *StateTracker) ReplyPrefix(cmd Command, target string) string {
+	if cmd.Prefix != "" {
+		return cmd.Prefix
+	}
+	if prefixes := st.CommandPrefixes(target); len(prefixes) > 0 {
+		return prefixes[0]
+	}
+	return ""
+}
+
+// Returns what follows `Nick:` or `Nick,` in a message addressed to the
+// bot
+func (st *StateTracker) addressed(message string) (string, bool) {
+	nick := st.conn.GetNick()
+	if len(message) <= len(nick) || !st.EqualFold(message[:len(nick)], nick) {
+		return "", false
+	}
+	rest := message[len(nick):]
+	if rest[0] != ':' && rest[0] != ',' {
+		return "", false
+	}
+	rest = strings.TrimSpace(rest[1:])
+	return rest, rest != ""
+}
@@ -2,47 +2,32 @@ package state
 
 import (
 	"github.com/thoj/go-ircevent"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func (st *StateTracker) joined(event *irc.Event) {
 	// Wait until ready
 	st.mutex.Lock()
 
-	channel := st.channels[event.Arguments[0]]
-	nick := st.nicks[event.Nick]
+	channel := st.getOrAddChannel(event.Arguments[0])
+	nick := st.getOrAddNick(event.Nick, true)
 
-	// Haven't seen this channel before
-	if channel == nil {
-		// Create a channel object
-		channel = &Channel{
-			Name:  event.Arguments[0],
-			Nicks: make(map[string]*ChannelPrivileges),
-		}
-
-		// Put it in the channels map
-		st.channels[event.Arguments[0]] = channel
-
-		// Get some initial info about it
-		st.conn.Mode(channel.Name)
-		st.conn.Who(channel.Name)
+	if nick.User == "" {
+		nick.User = event.User
+		nick.Host = event.Host
 	}
 
-	// Not seen this nick before
-	if nick == nil {
-		// Create a nick object
-		nick = &Nick{
-			Nick:     event.Nick,
-			User:     event.User,
-			Host:     event.Host,
-			Channels: make(map[string]*ChannelPrivileges),
-		}
-
-		// Put it in the nicks map
-		st.nicks[event.Nick] = nick
+	// extended-join adds the account and real name
+	if len(event.Arguments) >= 3 {
+		nick.Account = accountName(event.Arguments[1])
+		nick.Name = event.Arguments[2]
+	}
 
-		// Get some inital info about it
-		st.conn.Who(nick.Nick)
+	// Servers echo our own joins with the channel's canonical casing
+	if st.fold(event.Nick) == st.fold(st.conn.GetNick()) {
+		channel.Name = event.Arguments[0]
 	}
 
 	// Associate the nick with the channel
@@ -54,7 +39,8 @@ func (st *StateTracker) joined(event *irc.Event) {
 
 func (st *StateTracker) kicked(event *irc.Event) {
 	st.mutex.Lock()
-	st.disassociate(event.Nick, event.Arguments[0])
+	// KICK <channel> <nick> [:reason], event.Nick is whoever kicked
+	st.disassociate(event.Arguments[1], event.Arguments[0])
 	st.mutex.Unlock()
 }
 
@@ -84,8 +70,8 @@ func (st *StateTracker) topicSet(event *irc.Event) {
 
 func (st *StateTracker) whoisReply(event *irc.Event) {
 	st.mutex.Lock()
-	nick := st.nicks[event.Arguments[1]]
-	if nick != nil && nick != st.GetNick(st.conn.GetNick()) {
+	nick := st.nicks[st.fold(event.Arguments[1])]
+	if nick != nil && nick != st.me() {
 		nick.User = event.Arguments[2]
 		nick.Host = event.Arguments[3]
 		nick.Name = event.Arguments[5]
@@ -95,23 +81,95 @@ func (st *StateTracker) whoisReply(event *irc.Event) {
 
 func (st *StateTracker) modeReply(event *irc.Event) {
 	st.mutex.Lock()
-	if channel, ok := st.channels[event.Arguments[0]]; ok {
-		channel.ParseModes(event.Arguments[1], event.Arguments[2:]...)
+	if channel, ok := st.channels[st.fold(event.Arguments[0])]; ok && len(event.Arguments) > 1 {
+		channel.ParseModes(st.info, event.Nick, event.Arguments[1], event.Arguments[2:]...)
+	}
+	st.mutex.Unlock()
+}
+
+func (st *StateTracker) channelModeReply(event *irc.Event) {
+	st.mutex.Lock()
+	if channel, ok := st.channels[st.fold(event.Arguments[1])]; ok && len(event.Arguments) > 2 {
+		channel.ParseModes(st.info, "", event.Arguments[2], event.Arguments[3:]...)
+	}
+	st.mutex.Unlock()
+}
+
+// List modes filled by each list and end of list reply
+var listReplyModes = map[string]byte{
+	"367": 'b', "368": 'b', // RPL_BANLIST, RPL_ENDOFBANLIST
+	"348": 'e', "349": 'e', // RPL_EXCEPTLIST, RPL_ENDOFEXCEPTLIST
+	"346": 'I', "347": 'I', // RPL_INVITELIST, RPL_ENDOFINVITELIST
+	"728": 'q', "729": 'q', // RPL_QUIETLIST, RPL_ENDOFQUIETLIST
+}
+
+func (st *StateTracker) listReply(event *irc.Event) {
+	args := event.Arguments
+	// Quiet list replies carry the mode letter before the mask
+	if event.Code == "728" && len(args) > 2 {
+		args = append(args[:2:2], args[3:]...)
+	}
+
+	if len(args) < 3 {
+		return
+	}
+
+	st.mutex.Lock()
+	if channel, ok := st.channels[st.fold(args[1])]; ok {
+		entry := ListEntry{Mask: args[2]}
+		if len(args) > 3 {
+			entry.SetBy = args[3]
+		}
+		if len(args) > 4 {
+			if ts, err := strconv.ParseInt(args[4], 10, 64); err == nil {
+				entry.SetAt = time.Unix(ts, 0)
+			}
+		}
+		channel.receiveListEntry(listReplyModes[event.Code], entry)
+	}
+	st.mutex.Unlock()
+}
+
+func (st *StateTracker) endOfListReply(event *irc.Event) {
+	if len(event.Arguments) < 2 {
+		return
+	}
+
+	st.mutex.Lock()
+	if channel, ok := st.channels[st.fold(event.Arguments[1])]; ok {
+		channel.endList(listReplyModes[event.Code])
+	}
+	st.mutex.Unlock()
+}
+
+func (st *StateTracker) isupportReply(event *irc.Event) {
+	st.mutex.Lock()
+	// Skip our nick and the trailing "are supported by this server"
+	if len(event.Arguments) > 2 {
+		casemapping := st.info.CaseMapping
+		for _, token := range event.Arguments[1 : len(event.Arguments)-1] {
+			st.info.ParseToken(token)
+		}
+
+		// Names seen so far were keyed using the old casemapping
+		if casemapping != st.info.CaseMapping {
+			st.rekey()
+		}
 	}
 	st.mutex.Unlock()
 }
 
 func (st *StateTracker) topicReply(event *irc.Event) {
 	st.mutex.Lock()
-	if channel := st.channels[event.Arguments[0]]; channel != nil {
-		st.setTopic(channel.Name, event.Arguments[1])
+	if channel := st.channels[st.fold(event.Arguments[1])]; channel != nil {
+		st.setTopic(channel.Name, event.Arguments[2])
 	}
 	st.mutex.Unlock()
 }
 
 func (st *StateTracker) whoReply(event *irc.Event) {
 	st.mutex.Lock()
-	if nick, ok := st.nicks[event.Arguments[5]]; ok {
+	if nick, ok := st.nicks[st.fold(event.Arguments[5])]; ok {
 		nick.User = event.Arguments[2]
 		nick.Host = event.Arguments[3]
 		if idx := strings.Index(event.Arguments[6], "*"); idx != -1 {
@@ -120,46 +178,151 @@ func (st *StateTracker) whoReply(event *irc.Event) {
 		if idx := strings.Index(event.Arguments[6], "H"); idx != -1 {
 			nick.Modes.Invisible = true
 		}
+		nick.Away = strings.Contains(event.Arguments[6], "G")
+	}
+	st.mutex.Unlock()
+}
+
+func (st *StateTracker) whoxReply(event *irc.Event) {
+	// Only our own %tcuhnfa queries are understood
+	if len(event.Arguments) < 8 || event.Arguments[1] != whoxToken {
+		return
+	}
+
+	st.mutex.Lock()
+	if nick, ok := st.nicks[st.fold(event.Arguments[5])]; ok {
+		nick.User = event.Arguments[3]
+		nick.Host = event.Arguments[4]
+		nick.Away = strings.Contains(event.Arguments[6], "G")
+		if strings.Contains(event.Arguments[6], "*") {
+			nick.Modes.Oper = true
+		}
+		nick.Account = accountName(event.Arguments[7])
+	}
+	st.mutex.Unlock()
+}
+
+func (st *StateTracker) accountChanged(event *irc.Event) {
+	st.mutex.Lock()
+	if nick, ok := st.nicks[st.fold(event.Nick)]; ok && len(event.Arguments) > 0 {
+		nick.Account = accountName(event.Arguments[0])
+	}
+	st.mutex.Unlock()
+}
+
+func (st *StateTracker) awayChanged(event *irc.Event) {
+	st.mutex.Lock()
+	if nick, ok := st.nicks[st.fold(event.Nick)]; ok {
+		nick.AwayMessage = ""
+		if len(event.Arguments) > 0 {
+			nick.AwayMessage = event.Arguments[0]
+		}
+		nick.Away = nick.AwayMessage != ""
+	}
+	st.mutex.Unlock()
+}
+
+func (st *StateTracker) hostChanged(event *irc.Event) {
+	st.mutex.Lock()
+	if nick, ok := st.nicks[st.fold(event.Nick)]; ok && len(event.Arguments) > 1 {
+		nick.User = event.Arguments[0]
+		nick.Host = event.Arguments[1]
+	}
+	st.mutex.Unlock()
+}
+
+func (st *StateTracker) whoisAccountReply(event *irc.Event) {
+	st.mutex.Lock()
+	if nick, ok := st.nicks[st.fold(event.Arguments[1])]; ok && len(event.Arguments) > 2 {
+		nick.Account = event.Arguments[2]
+	}
+	st.mutex.Unlock()
+}
+
+func (st *StateTracker) awayReply(event *irc.Event) {
+	st.mutex.Lock()
+	if nick, ok := st.nicks[st.fold(event.Arguments[1])]; ok && len(event.Arguments) > 2 {
+		nick.Away = true
+		nick.AwayMessage = event.Arguments[2]
+	}
+	st.mutex.Unlock()
+}
+
+func (st *StateTracker) selfAwayReply(event *irc.Event) {
+	st.mutex.Lock()
+	if me := st.me(); me != nil {
+		// 306 RPL_NOWAWAY, 305 RPL_UNAWAY
+		me.Away = event.Code == "306"
+		if !me.Away {
+			me.AwayMessage = ""
+		}
 	}
 	st.mutex.Unlock()
 }
 
+func (st *StateTracker) loggedIn(event *irc.Event) {
+	st.mutex.Lock()
+	if me := st.me(); me != nil {
+		// 900 RPL_LOGGEDIN carries the account, 901 RPL_LOGGEDOUT doesn't
+		me.Account = ""
+		if event.Code == "900" && len(event.Arguments) > 2 {
+			me.Account = event.Arguments[2]
+		}
+	}
+	st.mutex.Unlock()
+}
+
+// Account names of * or 0 mean not logged in
+func accountName(account string) string {
+	if account == "*" || account == "0" {
+		return ""
+	}
+	return account
+}
+
 func (st *StateTracker) namesReply(event *irc.Event) {
 	st.mutex.Lock()
-	if channel, ok := st.channels[event.Arguments[2]]; ok {
-		names := strings.Split(strings.TrimSpace(event.Arguments[len(event.Arguments)-1]), " ")
+	if channel, ok := st.channels[st.fold(event.Arguments[2])]; ok {
+		names := strings.Fields(event.Arguments[len(event.Arguments)-1])
 		for _, name := range names {
-			switch priv := name[0]; priv {
-			case '~', '&', '@', '%', '+':
-				name = name[1:]
-				fallthrough
-			default:
-				nick := st.nicks[name]
-
-				if nick == nil {
-					st.nicks[name] = &Nick{
-						Nick:     name,
-						Channels: make(map[string]*ChannelPrivileges),
-					}
-				}
-				privs, ok := channel.Nicks[name]
+			// Strip the privilege prefixes, multi-prefix can send several
+			var modes []byte
+			for len(name) > 0 {
+				mode, ok := st.info.PrefixMode(name[0])
 				if !ok {
-					privs = st.associate(name, channel.Name)
+					break
 				}
+				modes = append(modes, mode)
+				name = name[1:]
+			}
 
-				switch priv {
-				case '~':
-					privs.Owner = true
-				case '&':
-					privs.Admin = true
-				case '@':
-					privs.Op = true
-				case '%':
-					privs.HalfOp = true
-				case '+':
-					privs.Voice = true
+			// userhost-in-names sends nick!user@host
+			var user, host string
+			if idx := strings.Index(name, "!"); idx != -1 {
+				user, name = name[idx+1:], name[:idx]
+				if idx = strings.Index(user, "@"); idx != -1 {
+					user, host = user[:idx], user[idx+1:]
 				}
 			}
+
+			if name == "" {
+				continue
+			}
+
+			// Skip the WHO, names replies hold everything we need
+			nick := st.getOrAddNick(name, false)
+			if user != "" {
+				nick.User = user
+				nick.Host = host
+			}
+
+			privs, ok := channel.Nicks[st.fold(name)]
+			if !ok {
+				privs = st.associate(name, channel.Name)
+			}
+			for _, mode := range modes {
+				privs.setMode(mode, true)
+			}
 		}
 	}
 	st.mutex.Unlock()
@@ -167,7 +330,7 @@ func (st *StateTracker) namesReply(event *irc.Event) {
 
 func (st *StateTracker) whoisReplySSL(event *irc.Event) {
 	st.mutex.Lock()
-	if nick, ok := st.nicks[event.Arguments[0]]; ok && nick != st.GetNick(st.conn.GetNick()) {
+	if nick, ok := st.nicks[st.fold(event.Arguments[0])]; ok && nick != st.me() {
 		nick.User = event.Arguments[1]
 		nick.Host = event.Arguments[2]
 		nick.Name = event.Arguments[4]
@@ -183,10 +346,28 @@ func (st *StateTracker) InitStateCallbacks() {
 	st.conn.AddCallback("PART", st.parted)
 	st.conn.AddCallback("QUIT", st.quitted)
 	st.conn.AddCallback("TOPIC", st.topicSet)
+	st.conn.AddCallback("ACCOUNT", st.accountChanged)
+	st.conn.AddCallback("AWAY", st.awayChanged)
+	st.conn.AddCallback("CHGHOST", st.hostChanged)
+	st.conn.AddCallback("005", st.isupportReply)
+	st.conn.AddCallback("301", st.awayReply)
+	st.conn.AddCallback("305", st.selfAwayReply)
+	st.conn.AddCallback("306", st.selfAwayReply)
 	st.conn.AddCallback("311", st.whoisReply)
+	st.conn.AddCallback("330", st.whoisAccountReply)
 	st.conn.AddCallback("MODE", st.modeReply)
+	st.conn.AddCallback("324", st.channelModeReply)
 	st.conn.AddCallback("332", st.topicReply)
 	st.conn.AddCallback("352", st.whoReply)
 	st.conn.AddCallback("353", st.namesReply)
+	st.conn.AddCallback("354", st.whoxReply)
 	st.conn.AddCallback("671", st.whoisReplySSL)
+	st.conn.AddCallback("900", st.loggedIn)
+	st.conn.AddCallback("901", st.loggedIn)
+	for _, code := range []string{"367", "348", "346", "728"} {
+		st.conn.AddCallback(code, st.listReply)
+	}
+	for _, code := range []string{"368", "349", "347", "729"} {
+		st.conn.AddCallback(code, st.endOfListReply)
+	}
 }
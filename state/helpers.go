@@ -1,8 +1,12 @@
 package state
 
-func (st *StateTracker) associate(nick, channel string) *ChannelPrivileges {
-	channelObj := st.channels[channel]
-	nickObj := st.nicks[nick]
+import (
+	"strings"
+)
+
+// Returns the tracked channel, creating it if we haven't seen it before
+func (st *StateTracker) getOrAddChannel(channel string) *Channel {
+	channelObj := st.channels[st.fold(channel)]
 
 	// Haven't seen this channel before
 	if channelObj == nil {
@@ -10,15 +14,23 @@ func (st *StateTracker) associate(nick, channel string) *ChannelPrivileges {
 		channelObj = &Channel{
 			Name:  channel,
 			Nicks: make(map[string]*ChannelPrivileges),
+			fold:  st.fold,
 		}
 
 		// Put it in the channels map
-		st.channels[channel] = channelObj
+		st.channels[st.fold(channel)] = channelObj
 
 		// Get some initial info about it
-		st.conn.Mode(channelObj.Name)
-		st.conn.Who(channelObj.Name)
+		st.queue.Mode(channelObj.Name)
+		st.who(channelObj.Name)
+		st.requestLists(channelObj.Name)
 	}
+	return channelObj
+}
+
+// Returns the tracked nick, creating it if we haven't seen it before
+func (st *StateTracker) getOrAddNick(nick string, who bool) *Nick {
+	nickObj := st.nicks[st.fold(nick)]
 
 	// Not seen this nick before
 	if nickObj == nil {
@@ -26,73 +38,108 @@ func (st *StateTracker) associate(nick, channel string) *ChannelPrivileges {
 		nickObj = &Nick{
 			Nick:     nick,
 			Channels: make(map[string]*ChannelPrivileges),
+			fold:     st.fold,
 		}
 
 		// Put it in the nicks map
-		st.nicks[nick] = nickObj
+		st.nicks[st.fold(nick)] = nickObj
 
 		// Get some inital info about it
-		st.conn.Who(nickObj.Nick)
+		if who {
+			st.who(nickObj.Nick)
+		}
+	}
+	return nickObj
+}
+
+// Token identifying replies to our own WHOX queries
+const whoxToken = "42"
+
+// Sends a WHO, asking for account names when the server supports WHOX
+func (st *StateTracker) who(target string) {
+	if st.info.WhoX {
+		st.queue.SendRawf("WHO %s %%tcuhnfa,%s", target, whoxToken)
+	} else {
+		st.queue.Who(target)
 	}
+}
+
+// Asks for the ban, exception, invite exception and quiet lists the
+// server supports
+func (st *StateTracker) requestLists(channel string) {
+	for _, mode := range []byte("beIq") {
+		if strings.IndexByte(st.info.ListModes, mode) != -1 && strings.IndexByte(st.info.PrefixModes, mode) == -1 {
+			st.queue.Mode(channel, string(mode))
+		}
+	}
+}
+
+func (st *StateTracker) associate(nick, channel string) *ChannelPrivileges {
+	channelObj := st.getOrAddChannel(channel)
+	nickObj := st.getOrAddNick(nick, true)
 
 	privs := new(ChannelPrivileges)
-	nickObj.Channels[channel] = privs
-	channelObj.Nicks[nick] = privs
+	nickObj.Channels[st.fold(channel)] = privs
+	channelObj.Nicks[st.fold(nick)] = privs
 	return privs
 }
 
 func (st *StateTracker) disassociate(nick, channel string) {
-	if channelObj, ok := st.channels[channel]; ok {
-		delete(channelObj.Nicks, nick)
+	// Once we left, nothing we know about the channel stays up to date
+	if st.fold(nick) == st.fold(st.conn.GetNick()) {
+		st.deleteChannel(channel)
+		return
+	}
+
+	if channelObj, ok := st.channels[st.fold(channel)]; ok {
+		delete(channelObj.Nicks, st.fold(nick))
 	}
-	if nickObj, ok := st.nicks[nick]; ok {
-		delete(nickObj.Channels, channel)
+	if nickObj, ok := st.nicks[st.fold(nick)]; ok {
+		delete(nickObj.Channels, st.fold(channel))
+	}
+}
+
+// Forgets a channel and its members
+func (st *StateTracker) deleteChannel(channel string) {
+	key := st.fold(channel)
+	if channelObj, ok := st.channels[key]; ok {
+		for nick := range channelObj.Nicks {
+			if nickObj, ok := st.nicks[nick]; ok {
+				delete(nickObj.Channels, key)
+			}
+		}
+		delete(st.channels, key)
 	}
 }
 
 func (st *StateTracker) changeNick(oldNick, newNick string) {
-	if nick, ok := st.nicks[oldNick]; ok {
+	oldKey, newKey := st.fold(oldNick), st.fold(newNick)
+	if nick, ok := st.nicks[oldKey]; ok {
+		// Keep the new display casing, even if the key doesn't change
 		nick.Nick = newNick
-		st.nicks[newNick] = nick
-		delete(st.nicks, oldNick)
+		delete(st.nicks, oldKey)
+		st.nicks[newKey] = nick
 	}
 	for _, channel := range st.channels {
-		if privs, ok := channel.Nicks[oldNick]; ok {
-			channel.Nicks[newNick] = privs
-			delete(channel.Nicks, oldNick)
+		if privs, ok := channel.Nicks[oldKey]; ok {
+			delete(channel.Nicks, oldKey)
+			channel.Nicks[newKey] = privs
 		}
 	}
 }
 
 func (st *StateTracker) deleteNick(nick string) {
-	if _, ok := st.nicks[nick]; ok {
-		delete(st.nicks, nick)
+	key := st.fold(nick)
+	if _, ok := st.nicks[key]; ok {
+		delete(st.nicks, key)
 	}
 	for _, channel := range st.channels {
-		if _, ok := channel.Nicks[nick]; ok {
-			delete(channel.Nicks, nick)
+		if _, ok := channel.Nicks[key]; ok {
+			delete(channel.Nicks, key)
 		}
 	}
 }
 
 func (st *StateTracker) setTopic(channel, topic string) {
-	channelObj := st.channels[channel]
-
-	// Haven't seen this channel before
-	if channelObj == nil {
-		// Create a channel object
-		channelObj = &Channel{
-			Name:  channel,
-			Nicks: make(map[string]*ChannelPrivileges),
-		}
-
-		// Put it in the channels map
-		st.channels[channel] = channelObj
-
-		// Get some initial info about it
-		st.conn.Mode(channelObj.Name)
-		st.conn.Who(channelObj.Name)
-	}
-
-	channelObj.Topic = topic
+	st.getOrAddChannel(channel).Topic = topic
 }
@@ -0,0 +1,178 @@
+package state
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Server features advertised through RPL_ISUPPORT (005)
+type ServerInfo struct {
+	// PREFIX, channel privilege modes and the matching nick prefixes,
+	// ordered from highest to lowest
+	PrefixModes, PrefixSymbols string
+
+	// CHANMODES, split into list modes, modes that always take an
+	// argument, modes that take one only when set and flag modes
+	ListModes, ParamModes, SetParamModes, FlagModes string
+
+	// CHANTYPES, CASEMAPPING
+	ChanTypes, CaseMapping string
+
+	// NICKLEN, MODES (0 when unlimited)
+	NickLen, Modes int
+
+	// TARGMAX, max targets per command (0 when unlimited)
+	TargMax map[string]int
+
+	// WHOX, whether WHO accepts a field list
+	WhoX bool
+}
+
+// Returns server info with the defaults used until the server tells us
+// otherwise
+func NewServerInfo() *ServerInfo {
+	return &ServerInfo{
+		PrefixModes:   "qaohv",
+		PrefixSymbols: "~&@%+",
+		ListModes:     "beI",
+		ParamModes:    "k",
+		SetParamModes: "l",
+		FlagModes:     "imnpst",
+		ChanTypes:     "#&",
+		CaseMapping:   "rfc1459",
+		NickLen:       9,
+		Modes:         3,
+		TargMax:       make(map[string]int),
+	}
+}
+
+// Returns a deep copy of the server info
+func (info *ServerInfo) Copy() *ServerInfo {
+	c := *info
+	c.TargMax = make(map[string]int, len(info.TargMax))
+	for cmd, max := range info.TargMax {
+		c.TargMax[cmd] = max
+	}
+	return &c
+}
+
+// Parses a single ISUPPORT token, e.g. PREFIX=(ov)@+
+func (info *ServerInfo) ParseToken(token string) {
+	var key, value string
+	if idx := strings.Index(token, "="); idx != -1 {
+		key, value = token[:idx], unescapeISupport(token[idx+1:])
+	} else {
+		key = token
+	}
+
+	// Negated tokens go back to their defaults
+	if strings.HasPrefix(key, "-") {
+		key = key[1:]
+		defaults := NewServerInfo()
+		switch key {
+		case "PREFIX":
+			info.PrefixModes, info.PrefixSymbols = defaults.PrefixModes, defaults.PrefixSymbols
+		case "CHANMODES":
+			info.ListModes, info.ParamModes = defaults.ListModes, defaults.ParamModes
+			info.SetParamModes, info.FlagModes = defaults.SetParamModes, defaults.FlagModes
+		case "CHANTYPES":
+			info.ChanTypes = defaults.ChanTypes
+		case "CASEMAPPING":
+			info.CaseMapping = defaults.CaseMapping
+		case "NICKLEN":
+			info.NickLen = defaults.NickLen
+		case "MODES":
+			info.Modes = defaults.Modes
+		case "TARGMAX":
+			info.TargMax = defaults.TargMax
+		case "WHOX":
+			info.WhoX = false
+		}
+		return
+	}
+
+	switch key {
+	case "PREFIX":
+		// (modes)symbols, empty when the server has no prefixes
+		info.PrefixModes, info.PrefixSymbols = "", ""
+		if idx := strings.Index(value, ")"); strings.HasPrefix(value, "(") && idx != -1 {
+			modes, symbols := value[1:idx], value[idx+1:]
+			if len(modes) == len(symbols) {
+				info.PrefixModes, info.PrefixSymbols = modes, symbols
+			}
+		}
+	case "CHANMODES":
+		groups := strings.Split(value, ",")
+		for len(groups) < 4 {
+			groups = append(groups, "")
+		}
+		info.ListModes, info.ParamModes = groups[0], groups[1]
+		info.SetParamModes, info.FlagModes = groups[2], groups[3]
+	case "CHANTYPES":
+		info.ChanTypes = value
+	case "CASEMAPPING":
+		info.CaseMapping = strings.ToLower(value)
+	case "NICKLEN":
+		if n, err := strconv.Atoi(value); err == nil {
+			info.NickLen = n
+		}
+	case "MODES":
+		info.Modes, _ = strconv.Atoi(value)
+	case "TARGMAX":
+		info.TargMax = make(map[string]int)
+		for _, target := range strings.Split(value, ",") {
+			if idx := strings.Index(target, ":"); idx != -1 {
+				info.TargMax[strings.ToUpper(target[:idx])], _ = strconv.Atoi(target[idx+1:])
+			}
+		}
+	case "WHOX":
+		info.WhoX = true
+	}
+}
+
+// Whether the name is a channel, going by CHANTYPES
+func (info *ServerInfo) IsChannel(name string) bool {
+	return name != "" && strings.IndexByte(info.ChanTypes, name[0]) != -1
+}
+
+// Returns the privilege mode for a nick prefix symbol
+func (info *ServerInfo) PrefixMode(symbol byte) (mode byte, ok bool) {
+	if idx := strings.IndexByte(info.PrefixSymbols, symbol); idx != -1 {
+		return info.PrefixModes[idx], true
+	}
+	return 0, false
+}
+
+// Whether the mode takes an argument when being set (or unset)
+func (info *ServerInfo) ModeTakesArg(mode byte, set bool) bool {
+	switch {
+	case strings.IndexByte(info.PrefixModes, mode) != -1:
+		return true
+	case strings.IndexByte(info.ListModes, mode) != -1:
+		return true
+	case strings.IndexByte(info.ParamModes, mode) != -1:
+		return true
+	case strings.IndexByte(info.SetParamModes, mode) != -1:
+		return set
+	}
+	return false
+}
+
+// Undoes the \xHH escaping used in ISUPPORT values
+func unescapeISupport(value string) string {
+	if !strings.Contains(value, `\x`) {
+		return value
+	}
+	var out []byte
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+3 < len(value) && value[i+1] == 'x' {
+			if b, err := strconv.ParseUint(value[i+2:i+4], 16, 8); err == nil {
+				out = append(out, byte(b))
+				i += 3
+				continue
+			}
+		}
+		out = append(out, value[i])
+	}
+	return string(out)
+}
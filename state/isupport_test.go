@@ -0,0 +1,95 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		tokens []string
+		want   func(info *ServerInfo) // Changes from the defaults
+	}{
+		{"prefix", []string{"PREFIX=(ov)@+"}, func(info *ServerInfo) {
+			info.PrefixModes, info.PrefixSymbols = "ov", "@+"
+		}},
+		{"long prefix", []string{"PREFIX=(Yqaohv)!~&@%+"}, func(info *ServerInfo) {
+			info.PrefixModes, info.PrefixSymbols = "Yqaohv", "!~&@%+"
+		}},
+		{"empty prefix", []string{"PREFIX="}, func(info *ServerInfo) {
+			info.PrefixModes, info.PrefixSymbols = "", ""
+		}},
+		{"prefix without value", []string{"PREFIX"}, func(info *ServerInfo) {
+			info.PrefixModes, info.PrefixSymbols = "", ""
+		}},
+		{"mismatched prefix", []string{"PREFIX=(ov)@"}, func(info *ServerInfo) {
+			info.PrefixModes, info.PrefixSymbols = "", ""
+		}},
+		{"negated prefix", []string{"PREFIX=(ov)@+", "-PREFIX"}, func(info *ServerInfo) {}},
+		{"modes", []string{"MODES=6"}, func(info *ServerInfo) {
+			info.Modes = 6
+		}},
+		{"unlimited modes", []string{"MODES="}, func(info *ServerInfo) {
+			info.Modes = 0
+		}},
+		{"modes without value", []string{"MODES"}, func(info *ServerInfo) {
+			info.Modes = 0
+		}},
+		{"negated modes", []string{"MODES=6", "-MODES"}, func(info *ServerInfo) {}},
+		{"chanmodes", []string{"CHANMODES=beIq,k,fl,imnpst"}, func(info *ServerInfo) {
+			info.ListModes, info.ParamModes, info.SetParamModes, info.FlagModes = "beIq", "k", "fl", "imnpst"
+		}},
+		{"short chanmodes", []string{"CHANMODES=b,k"}, func(info *ServerInfo) {
+			info.ListModes, info.ParamModes, info.SetParamModes, info.FlagModes = "b", "k", "", ""
+		}},
+		{"escaped chantypes", []string{`CHANTYPES=#\x26`}, func(info *ServerInfo) {
+			info.ChanTypes = "#&"
+		}},
+		{"casemapping", []string{"CASEMAPPING=ASCII"}, func(info *ServerInfo) {
+			info.CaseMapping = "ascii"
+		}},
+		{"bad nicklen", []string{"NICKLEN=abc"}, func(info *ServerInfo) {}},
+		{"targmax", []string{"TARGMAX=PRIVMSG:4,notice:,JOIN"}, func(info *ServerInfo) {
+			info.TargMax = map[string]int{"PRIVMSG": 4, "NOTICE": 0}
+		}},
+		{"whox", []string{"WHOX"}, func(info *ServerInfo) {
+			info.WhoX = true
+		}},
+		{"unknown", []string{"NETWORK=Libera.Chat"}, func(info *ServerInfo) {}},
+	}
+
+	for _, test := range tests {
+		got := NewServerInfo()
+		for _, token := range test.tokens {
+			got.ParseToken(token)
+		}
+		want := NewServerInfo()
+		test.want(want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: parsing %q gave %+v, want %+v", test.name, test.tokens, got, want)
+		}
+	}
+}
+
+func TestUnescapeISupport(t *testing.T) {
+	tests := []struct {
+		value, want string
+	}{
+		{"plain", "plain"},
+		{`Example\x20Network`, "Example Network"},
+		{`\x20leading`, " leading"},
+		{`trailing\x20`, "trailing "},
+		{`a\x3Db\x5Cc`, `a=b\c`},
+		{`\x5Cx20`, `\x20`},
+		{`bad\xZZ`, `bad\xZZ`},
+		{`short\x2`, `short\x2`},
+		{`\x`, `\x`},
+	}
+
+	for _, test := range tests {
+		if got := unescapeISupport(test.value); got != test.want {
+			t.Errorf("unescapeISupport(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
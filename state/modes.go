@@ -0,0 +1,132 @@
+package state
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Longest MODE line we build, leaving room for the server's prefix
+const maxModeLine = 400
+
+// Single channel mode change, e.g. +v nick
+type ModeChange struct {
+	Set  bool
+	Mode byte
+	Arg  string
+}
+
+// Parses a mode change written as +v nick, -m or +l 20
+func ParseModeChange(change string) (ModeChange, bool) {
+	fields := strings.Fields(change)
+	if len(fields) == 0 || len(fields) > 2 || len(fields[0]) != 2 {
+		return ModeChange{}, false
+	}
+	if fields[0][0] != '+' && fields[0][0] != '-' {
+		return ModeChange{}, false
+	}
+
+	mc := ModeChange{Set: fields[0][0] == '+', Mode: fields[0][1]}
+	if len(fields) == 2 {
+		mc.Arg = fields[1]
+	}
+	return mc, true
+}
+
+func (mc ModeChange) String() string {
+	sign := "-"
+	if mc.Set {
+		sign = "+"
+	}
+	if mc.Arg == "" {
+		return sign + string(mc.Mode)
+	}
+	return sign + string(mc.Mode) + " " + mc.Arg
+}
+
+// Whether the channel already shows the change as applied
+func (channel *Channel) applied(info *ServerInfo, mc ModeChange) bool {
+	switch {
+	case strings.IndexByte(info.PrefixModes, mc.Mode) != -1:
+		privs, ok := channel.Nicks[channel.fold(mc.Arg)]
+		return ok && privs.hasMode(mc.Mode) == mc.Set
+	case strings.IndexByte(info.ListModes, mc.Mode) != -1:
+		// Lists may not have been received, so only a present entry counts
+		return mc.Set && channel.hasListEntry(mc.Mode, mc.Arg)
+	case mc.Mode == 'k':
+		return (mc.Set && channel.Modes.Key == mc.Arg) || (!mc.Set && channel.Modes.Key == "")
+	case mc.Mode == 'l':
+		return (mc.Set && strconv.Itoa(channel.Modes.Limit) == mc.Arg) || (!mc.Set && channel.Modes.Limit == 0)
+	}
+	if flag := channel.Modes.flag(mc.Mode); flag != nil {
+		return *flag == mc.Set
+	}
+	return false
+}
+
+// Sends the mode changes for a channel, grouped into as few MODE lines as
+// the server's MODES limit allows. Changes the channel already shows as
+// applied are skipped. Returns the number of changes sent.
+func (st *StateTracker) SetModes(c string, changes ...ModeChange) int {
+	st.mutex.RLock()
+	info := st.info.Copy()
+	pending := make([]ModeChange, 0, len(changes))
+	for _, mc := range changes {
+		if info.ModeTakesArg(mc.Mode, mc.Set) && mc.Arg == "" {
+			continue
+		}
+		if channel, ok := st.channels[st.fold(c)]; ok && channel.applied(info, mc) {
+			continue
+		}
+		pending = append(pending, mc)
+	}
+	st.mutex.RUnlock()
+
+	for _, line := range buildModeLines(info, c, pending) {
+		st.queue.SendRaw(line)
+	}
+	return len(pending)
+}
+
+// Groups mode changes into MODE lines holding at most info.Modes changes
+// with an argument each
+func buildModeLines(info *ServerInfo, channel string, changes []ModeChange) []string {
+	lines := make([]string, 0)
+	prefix := "MODE " + channel + " "
+
+	var modes, args []string
+	var sign byte
+	var withArg, length int
+	flush := func() {
+		if len(modes) > 0 {
+			lines = append(lines, prefix+strings.Join(append([]string{strings.Join(modes, "")}, args...), " "))
+		}
+		modes, args, sign, withArg, length = nil, nil, 0, 0, len(prefix)
+	}
+	flush()
+
+	for _, mc := range changes {
+		hasArg := info.ModeTakesArg(mc.Mode, mc.Set)
+		size := 2 + len(mc.Arg) + 1
+		if (hasArg && info.Modes > 0 && withArg >= info.Modes) || length+size > maxModeLine {
+			flush()
+		}
+
+		op := byte('-')
+		if mc.Set {
+			op = '+'
+		}
+		if op != sign {
+			modes = append(modes, string(op))
+			sign = op
+		}
+		modes = append(modes, string(mc.Mode))
+		if hasArg {
+			args = append(args, mc.Arg)
+			withArg++
+		}
+		length += size
+	}
+	flush()
+
+	return lines
+}
@@ -0,0 +1,76 @@
+package state
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBuildModeLines(t *testing.T) {
+	voice := func(nicks ...string) []ModeChange {
+		changes := make([]ModeChange, 0, len(nicks))
+		for _, nick := range nicks {
+			changes = append(changes, ModeChange{Set: true, Mode: 'v', Arg: nick})
+		}
+		return changes
+	}
+	ban := func(n int, mask string) []ModeChange {
+		changes := make([]ModeChange, 0, n)
+		for i := 0; i < n; i++ {
+			changes = append(changes, ModeChange{Set: true, Mode: 'b', Arg: mask})
+		}
+		return changes
+	}
+	long := strings.Repeat("x", 100)
+
+	tests := []struct {
+		name    string
+		modes   int // MODES, -1 to keep the default of 3
+		changes []ModeChange
+		want    []string
+	}{
+		{"nothing", -1, nil, []string{}},
+		{"one line", -1, voice("a", "b", "c"), []string{"MODE #c +vvv a b c"}},
+		{"split at MODES", -1, voice("a", "b", "c", "d"), []string{"MODE #c +vvv a b c", "MODE #c +v d"}},
+		{"higher MODES", 4, voice("a", "b", "c", "d", "e"), []string{"MODE #c +vvvv a b c d", "MODE #c +v e"}},
+		{"unlimited MODES", 0, voice("a", "b", "c", "d", "e"), []string{"MODE #c +vvvvv a b c d e"}},
+		{"mixed signs", -1, []ModeChange{
+			{Set: true, Mode: 'o', Arg: "a"},
+			{Set: false, Mode: 'v', Arg: "b"},
+			{Set: false, Mode: 'o', Arg: "c"},
+		}, []string{"MODE #c +o-vo a b c"}},
+		{"sign repeated on new line", -1, []ModeChange{
+			{Set: false, Mode: 'v', Arg: "a"},
+			{Set: false, Mode: 'v', Arg: "b"},
+			{Set: false, Mode: 'v', Arg: "c"},
+			{Set: false, Mode: 'v', Arg: "d"},
+		}, []string{"MODE #c -vvv a b c", "MODE #c -v d"}},
+		{"flags don't count", -1, []ModeChange{
+			{Set: true, Mode: 'm'},
+			{Set: true, Mode: 'v', Arg: "a"},
+			{Set: true, Mode: 'v', Arg: "b"},
+			{Set: true, Mode: 'v', Arg: "c"},
+			{Set: true, Mode: 'n'},
+		}, []string{"MODE #c +mvvvn a b c"}},
+		{"limit only takes an argument when set", -1, []ModeChange{
+			{Set: true, Mode: 'l', Arg: "10"},
+			{Set: false, Mode: 'l'},
+			{Set: true, Mode: 'k', Arg: "key"},
+		}, []string{"MODE #c +l-l+k 10 key"}},
+		{"split at line length", 0, ban(4, long), []string{
+			"MODE #c +bbb " + long + " " + long + " " + long,
+			"MODE #c +b " + long,
+		}},
+	}
+
+	for _, test := range tests {
+		info := NewServerInfo()
+		if test.modes >= 0 {
+			info.Modes = test.modes
+		}
+		got := buildModeLines(info, "#c", test.changes)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: buildModeLines() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
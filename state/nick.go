@@ -7,10 +7,20 @@ type NickModes struct {
 type Nick struct {
 	Nick, User, Host, Name string
 	Modes                  NickModes
-	Channels               map[string]*ChannelPrivileges
+
+	// Services account, empty when not logged in
+	Account string
+
+	// Away status and message
+	Away        bool
+	AwayMessage string
+
+	Channels map[string]*ChannelPrivileges // Keyed by case folded channel
+
+	fold func(string) string
 }
 
 func (n *Nick) InChannel(channel string) (isIn bool) {
-	_, isIn = n.Channels[channel]
+	_, isIn = n.Channels[n.fold(channel)]
 	return
 }
@@ -0,0 +1,66 @@
+package state
+
+// Point in time copy of a Nick, safe to use without holding the state lock
+type NickSnapshot struct {
+	Nick, User, Host, Name string
+	Modes                  NickModes
+	Account                string
+	Away                   bool
+	AwayMessage            string
+	Channels               map[string]MemberSnapshot // Keyed by folded channel name
+}
+
+// Point in time copy of a Channel, safe to use without holding the state lock
+type ChannelSnapshot struct {
+	Name, Topic string
+	Modes       ChannelModes
+	Nicks       map[string]MemberSnapshot // Keyed by folded nick
+}
+
+// Privileges of a nick in a channel, along with the name of the channel or
+// nick as it is displayed
+type MemberSnapshot struct {
+	Name string
+	ChannelPrivileges
+}
+
+// Copies a nick, must be called with the state lock held
+func (st *StateTracker) snapshotNick(nick *Nick) NickSnapshot {
+	snapshot := NickSnapshot{
+		Nick:        nick.Nick,
+		User:        nick.User,
+		Host:        nick.Host,
+		Name:        nick.Name,
+		Modes:       nick.Modes,
+		Account:     nick.Account,
+		Away:        nick.Away,
+		AwayMessage: nick.AwayMessage,
+		Channels:    make(map[string]MemberSnapshot, len(nick.Channels)),
+	}
+	for key, privs := range nick.Channels {
+		name := key
+		if channel, ok := st.channels[key]; ok {
+			name = channel.Name
+		}
+		snapshot.Channels[key] = MemberSnapshot{name, *privs}
+	}
+	return snapshot
+}
+
+// Copies a channel, must be called with the state lock held
+func (st *StateTracker) snapshotChannel(channel *Channel) ChannelSnapshot {
+	snapshot := ChannelSnapshot{
+		Name:  channel.Name,
+		Topic: channel.Topic,
+		Modes: channel.Modes.Copy(),
+		Nicks: make(map[string]MemberSnapshot, len(channel.Nicks)),
+	}
+	for key, privs := range channel.Nicks {
+		name := key
+		if nick, ok := st.nicks[key]; ok {
+			name = nick.Nick
+		}
+		snapshot.Nicks[key] = MemberSnapshot{name, *privs}
+	}
+	return snapshot
+}
@@ -3,6 +3,7 @@ package state
 import (
 	"github.com/thoj/go-ircevent"
 	"github.com/zenithar/aktarus/config"
+	"github.com/zenithar/aktarus/queue"
 	"sync"
 )
 
@@ -10,20 +11,35 @@ type StateTracker struct {
 	channels map[string]*Channel
 	nicks    map[string]*Nick
 	conn     *irc.Connection
-	mutex    sync.Mutex
+	queue    *queue.Queue
+	mutex    sync.RWMutex
 	cfg      *config.Settings
+	caps     *Capabilities
+	info     *ServerInfo
 }
 
-func New(cfg *config.Settings, conn *irc.Connection) *StateTracker {
+func New(cfg *config.Settings, conn *irc.Connection, queue *queue.Queue) *StateTracker {
 	state := &StateTracker{
 		channels: make(map[string]*Channel),
 		nicks:    make(map[string]*Nick),
 		conn:     conn,
+		queue:    queue,
 		cfg:      cfg,
+		caps:     NewCapabilities(),
+		info:     NewServerInfo(),
 	}
-	state.nicks[cfg.Irc.Nick] = &Nick{
-		Nick:     cfg.Irc.Nick,
-		Channels: make(map[string]*ChannelPrivileges),
-	}
+	state.getOrAddNick(cfg.Irc.Nick, false)
 	return state
 }
+
+// Forgets everything tracked, used when the connection is reset
+func (st *StateTracker) Reset() {
+	st.mutex.Lock()
+	st.channels = make(map[string]*Channel)
+	st.nicks = make(map[string]*Nick)
+	st.info = NewServerInfo()
+	st.getOrAddNick(st.cfg.Irc.Nick, false)
+	st.mutex.Unlock()
+
+	st.caps.Clear()
+}
@@ -1,45 +1,145 @@
 package state
 
-// Returns a Nick object
-func (st *StateTracker) GetNick(n string) (nick *Nick) {
-	nick, _ = st.nicks[n]
+import (
+	"fmt"
+	"github.com/zenithar/aktarus/config"
+	"strings"
+)
+
+// Returns a snapshot of the Nick
+func (st *StateTracker) GetNick(n string) (nick NickSnapshot, ok bool) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	var nickObj *Nick
+	if nickObj, ok = st.nicks[st.fold(n)]; ok {
+		nick = st.snapshotNick(nickObj)
+	}
 	return
 }
 
-// Returns a Channel object
-func (st *StateTracker) GetChannel(c string) (channel *Channel) {
-	channel, _ = st.channels[c]
+// Returns a snapshot of the Channel
+func (st *StateTracker) GetChannel(c string) (channel ChannelSnapshot, ok bool) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	var channelObj *Channel
+	if channelObj, ok = st.channels[st.fold(c)]; ok {
+		channel = st.snapshotChannel(channelObj)
+	}
 	return
 }
 
-// Returns Nick object for the bot
-func (st *StateTracker) Me() *Nick {
+// Returns a snapshot of the Nick for the bot
+func (st *StateTracker) Me() (nick NickSnapshot, ok bool) {
 	return st.GetNick(st.conn.GetNick())
 }
 
+// Returns the Nick object for the bot, must be called with the lock held
+func (st *StateTracker) me() *Nick {
+	return st.nicks[st.fold(st.conn.GetNick())]
+}
+
 // Return string slice of known nicks
 func (st *StateTracker) Nicks() (nicks []string) {
-	nicks = make([]string, 0)
-	for nick, _ := range st.nicks {
-		nicks = append(nicks, nick)
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	nicks = make([]string, 0, len(st.nicks))
+	for _, nick := range st.nicks {
+		nicks = append(nicks, nick.Nick)
 	}
 	return
 }
 
 // Return string slice of known channels
 func (st *StateTracker) Channels() (channels []string) {
-	channels = make([]string, 0)
-	for channel, _ := range st.channels {
-		channels = append(channels, channel)
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	channels = make([]string, 0, len(st.channels))
+	for _, channel := range st.channels {
+		channels = append(channels, channel.Name)
+	}
+	return
+}
+
+// Returns a copy of the ChannelPrivileges for the given nick.channel
+func (st *StateTracker) GetPrivs(c, n string) (privs ChannelPrivileges, ok bool) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	var channel *Channel
+	var privsObj *ChannelPrivileges
+	if channel, ok = st.channels[st.fold(c)]; ok {
+		if privsObj, ok = channel.Nicks[st.fold(n)]; ok {
+			privs = *privsObj
+		}
 	}
 	return
 }
 
-// Returns a ChannelPrivs object for the given nick.channel
-func (st *StateTracker) GetPrivs(c, n string) (privs *ChannelPrivileges, ok bool) {
+// Returns a copy of a channel's ban (b), exception (e), invite exception (I)
+// or quiet (q) list
+func (st *StateTracker) GetModeList(c string, mode byte) (list []ListEntry, ok bool) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
 	var channel *Channel
-	if channel, ok = st.channels[c]; ok {
-		privs, ok = channel.Nicks[n]
+	if channel, ok = st.channels[st.fold(c)]; ok {
+		if modeList := channel.Modes.list(mode); modeList != nil {
+			list = append([]ListEntry(nil), *modeList...)
+		} else {
+			ok = false
+		}
 	}
 	return
 }
+
+// Returns the capabilities negotiated with the server
+func (st *StateTracker) Caps() *Capabilities {
+	return st.caps
+}
+
+// Whether the server acknowledged the given capability
+func (st *StateTracker) HasCap(name string) bool {
+	return st.caps.Has(name)
+}
+
+// Returns a copy of the features the server advertised in RPL_ISUPPORT
+func (st *StateTracker) ServerInfo() *ServerInfo {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	return st.info.Copy()
+}
+
+// Returns the nick!user@host the server prefixes the bot's messages with,
+// assuming the longest user and host allowed while they aren't known yet
+func (st *StateTracker) Source() string {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	user, host := strings.Repeat("u", 10), strings.Repeat("h", 63)
+	if me := st.me(); me != nil {
+		if me.User != "" {
+			user = me.User
+		}
+		if me.Host != "" {
+			host = me.Host
+		}
+	}
+	return fmt.Sprintf("%s!%s@%s", st.conn.GetNick(), user, host)
+}
+
+// Returns the configured settings for a channel
+func (st *StateTracker) ChannelConfig(c string) (config.ChannelSettings, bool) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	for _, channel := range st.cfg.Channel {
+		if st.fold(channel.Name) == st.fold(c) {
+			return channel, true
+		}
+	}
+	return config.ChannelSettings{}, false
+}
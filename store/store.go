@@ -0,0 +1,231 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long changes are gathered before the store is written, so bursts of
+// writes only save it once
+const saveDelay = 2 * time.Second
+
+// Key-value store kept in a JSON file, values being JSON documents kept
+// per namespace
+type Store struct {
+	path  string
+	data  map[string]map[string]json.RawMessage
+	mutex sync.Mutex
+	log   *log.Logger
+
+	// Pending save, set while there are unsaved changes
+	timer *time.Timer
+
+	// Keeps saves from writing the file at the same time
+	saving sync.Mutex
+}
+
+// Opens the store at path, creating it on the first write
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path: path,
+		data: make(map[string]map[string]json.RawMessage),
+		log:  log.New(os.Stdout, "[store] ", log.LstdFlags),
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if err := json.NewDecoder(file).Decode(&s.data); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Schedules saving the store, along with whatever else changes in the
+// meantime. Must be called with the lock held.
+func (s *Store) changed() {
+	if s.timer == nil {
+		s.timer = time.AfterFunc(saveDelay, func() { s.Flush() })
+	}
+}
+
+// Writes pending changes right away
+func (s *Store) Flush() error {
+	s.saving.Lock()
+	defer s.saving.Unlock()
+
+	s.mutex.Lock()
+	if s.timer == nil {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.timer.Stop()
+	s.timer = nil
+	data, err := json.MarshalIndent(s.data, "", "\t")
+	s.mutex.Unlock()
+
+	if err != nil {
+		s.log.Printf("Couldn't save the store: %s\n", err)
+		return err
+	}
+	return s.write(data)
+}
+
+// Writes pending changes, for shutting down
+func (s *Store) Close() error {
+	return s.Flush()
+}
+
+// Writes the store to a temporary file, then moves it over the old one so
+// a crash can't leave it half written
+func (s *Store) write(data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		s.log.Printf("Couldn't save the store: %s\n", err)
+	}
+	return err
+}
+
+// Writes every namespace as JSON, for backups
+func (s *Store) Export(w io.Writer) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data, err := json.MarshalIndent(s.data, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// Replaces the namespaces found in a JSON export, leaving the others alone
+func (s *Store) Import(r io.Reader) error {
+	var data map[string]map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	for namespace, values := range data {
+		s.data[namespace] = values
+	}
+	s.changed()
+	s.mutex.Unlock()
+
+	return s.Flush()
+}
+
+// Returns the keys and values of a plugin, kept apart from the others
+func (s *Store) Namespace(name string) *Namespace {
+	return &Namespace{store: s, name: name}
+}
+
+type Namespace struct {
+	store *Store
+	name  string
+}
+
+// Returns the JSON value stored for the key
+func (ns *Namespace) Get(key string) (json.RawMessage, bool) {
+	ns.store.mutex.Lock()
+	defer ns.store.mutex.Unlock()
+
+	value, ok := ns.store.data[ns.name][key]
+	return value, ok
+}
+
+// Stores a JSON value for the key
+func (ns *Namespace) Set(key string, value json.RawMessage) error {
+	if !json.Valid(value) {
+		return errors.New("value isn't valid JSON")
+	}
+
+	ns.store.mutex.Lock()
+	defer ns.store.mutex.Unlock()
+
+	if ns.store.data[ns.name] == nil {
+		ns.store.data[ns.name] = make(map[string]json.RawMessage)
+	}
+	ns.store.data[ns.name][key] = value
+	ns.store.changed()
+	return nil
+}
+
+// Removes the key
+func (ns *Namespace) Delete(key string) error {
+	ns.store.mutex.Lock()
+	defer ns.store.mutex.Unlock()
+
+	if _, ok := ns.store.data[ns.name][key]; !ok {
+		return nil
+	}
+	delete(ns.store.data[ns.name], key)
+	ns.store.changed()
+	return nil
+}
+
+// Returns the keys starting with prefix, sorted
+func (ns *Namespace) List(prefix string) []string {
+	ns.store.mutex.Lock()
+	defer ns.store.mutex.Unlock()
+
+	keys := make([]string, 0)
+	for key := range ns.store.data[ns.name] {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Adds by to the number stored for the key, missing keys counting as 0,
+// and returns the result
+func (ns *Namespace) Increment(key string, by float64) (float64, error) {
+	ns.store.mutex.Lock()
+	defer ns.store.mutex.Unlock()
+
+	var current float64
+	if value, ok := ns.store.data[ns.name][key]; ok {
+		if err := json.Unmarshal(value, &current); err != nil {
+			return 0, errors.New("value isn't a number")
+		}
+	}
+	current += by
+
+	if ns.store.data[ns.name] == nil {
+		ns.store.data[ns.name] = make(map[string]json.RawMessage)
+	}
+	ns.store.data[ns.name][key] = json.RawMessage(strconv.FormatFloat(current, 'f', -1, 64))
+	ns.store.changed()
+	return current, nil
+}
@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		spec string
+		ok   bool
+	}{
+		{"* * * * *", true},
+		{"*/15 9-17 * * 1-5", true},
+		{"5/15 * * * *", true},
+		{"0 0 1,15 * 7", true},
+		{"@weekly", true},
+		{" @daily ", true},
+		{"* * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+		{"*/0 * * * *", false},
+		{"5-1 * * * *", false},
+		{"a * * * *", false},
+		{"@fortnightly", false},
+	}
+
+	for _, test := range tests {
+		if _, err := ParseCron(test.spec); (err == nil) != test.ok {
+			t.Errorf("ParseCron(%q) gave error %v, want ok %t", test.spec, err, test.ok)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	utc := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2026, month, day, hour, min, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name string
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"every minute", "* * * * *", utc(10, 14, 10, 7), utc(10, 14, 10, 8)},
+		{"seconds dropped", "* * * * *", utc(10, 14, 10, 7).Add(30 * time.Second), utc(10, 14, 10, 8)},
+		{"every 15 minutes", "*/15 * * * *", utc(10, 14, 10, 7), utc(10, 14, 10, 15)},
+		{"every 15 minutes, next hour", "*/15 * * * *", utc(10, 14, 10, 45), utc(10, 14, 11, 0)},
+		{"every 15 from 5", "5/15 * * * *", utc(10, 14, 10, 21), utc(10, 14, 10, 35)},
+		{"every 15 from 5, next hour", "5/15 * * * *", utc(10, 14, 10, 50), utc(10, 14, 11, 5)},
+		{"sunday as 0", "0 12 * * 0", utc(10, 14, 0, 0), utc(10, 18, 12, 0)},
+		{"sunday as 7", "0 12 * * 7", utc(10, 14, 0, 0), utc(10, 18, 12, 0)},
+		{"range up to 7", "0 12 * * 5-7", utc(10, 17, 13, 0), utc(10, 18, 12, 0)},
+		{"day of month or week, week first", "0 9 13 * 5", utc(10, 14, 0, 0), utc(10, 16, 9, 0)},
+		{"day of month or week, month first", "0 9 13 * 5", utc(10, 12, 0, 0), utc(10, 13, 9, 0)},
+		{"day of month only", "0 9 13 * *", utc(10, 14, 0, 0), utc(11, 13, 9, 0)},
+		{"weekly", "@weekly", utc(10, 14, 10, 0), utc(10, 18, 0, 0)},
+		{"monthly", "@monthly", utc(10, 14, 10, 0), utc(11, 1, 0, 0)},
+		{"31st skips short months", "0 0 31 * *", utc(9, 1, 0, 0), utc(10, 31, 0, 0)},
+		{"february 30th", "0 0 30 2 *", utc(10, 14, 0, 0), time.Time{}},
+	}
+
+	for _, test := range tests {
+		s, err := ParseCron(test.spec)
+		if err != nil {
+			t.Errorf("%s: ParseCron(%q) failed: %s", test.name, test.spec, err)
+			continue
+		}
+		if got := s.Next(test.from); !got.Equal(test.want) {
+			t.Errorf("%s: Next(%s) of %q = %s, want %s", test.name, test.from, test.spec, got, test.want)
+		}
+	}
+}
+
+func TestCronNextDST(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no time zone data: %s", err)
+	}
+	local := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2026, month, day, hour, min, 0, 0, ny)
+	}
+
+	// Clocks go from 2:00 EST to 3:00 EDT on March 8th, and back from
+	// 2:00 EDT to 1:00 EST on November 1st
+	springForward := local(3, 8, 1, 59).Add(time.Minute)
+	fallBack := local(11, 1, 1, 59).Add(time.Minute)
+	if springForward.Hour() != 3 || fallBack.Hour() != 1 {
+		t.Skipf("time zone data doesn't have the 2026 transitions")
+	}
+
+	tests := []struct {
+		name string
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"skipped hour", "30 2 * * *", local(3, 8, 0, 0), local(3, 9, 2, 30)},
+		{"hourly across spring forward", "0 * * * *", local(3, 8, 1, 30), springForward},
+		{"daily after spring forward", "0 9 * * *", local(3, 7, 12, 0), local(3, 8, 9, 0)},
+		{"every 15 minutes across fall back", "*/15 * * * *", fallBack.Add(-15 * time.Minute), fallBack},
+		{"daily after fall back", "0 9 * * *", local(10, 31, 12, 0), local(11, 1, 9, 0)},
+	}
+
+	for _, test := range tests {
+		s, err := ParseCron(test.spec)
+		if err != nil {
+			t.Errorf("%s: ParseCron(%q) failed: %s", test.name, test.spec, err)
+			continue
+		}
+		if got := s.Next(test.from); !got.Equal(test.want) {
+			t.Errorf("%s: Next(%s) of %q = %s, want %s", test.name, test.from, test.spec, got, test.want)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"html"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -12,6 +13,16 @@ import (
 )
 
 func GetPage(url string) (string, error) {
+	return getPage(url, 0)
+}
+
+// Same as GetPage, failing for pages of more than max bytes
+func GetPageLimited(url string, max int64) (string, error) {
+	return getPage(url, max)
+}
+
+// Fetches the page at url, limited to max bytes unless max is 0
+func getPage(url string, max int64) (string, error) {
 	client := newHttpTimeoutClient()
 
 	req, err := http.NewRequest("GET", url, nil)
@@ -29,11 +40,22 @@ func GetPage(url string) (string, error) {
 	}
 
 	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	var body []byte
+	if max > 0 {
+		if resp.ContentLength > max {
+			return "", fmt.Errorf("Page is %d bytes, more than the %d bytes allowed", resp.ContentLength, max)
+		}
+		body, err = ioutil.ReadAll(io.LimitReader(resp.Body, max+1))
+	} else {
+		body, err = ioutil.ReadAll(resp.Body)
+	}
 	if err != nil {
 		logger.Printf("Couldn't read http response body: %s", err.Error())
 		return "", err
 	}
+	if max > 0 && int64(len(body)) > max {
+		return "", fmt.Errorf("Page is more than the %d bytes allowed", max)
+	}
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		logger.Printf("HTTP response code: %d", resp.StatusCode)
@@ -3,36 +3,37 @@ package utils
 import (
 	"fmt"
 	"github.com/thoj/go-ircevent"
+	"github.com/zenithar/aktarus/queue"
 	"strings"
 	"time"
 )
 
-func IRCAction(conn *irc.Connection, channel, action string) {
-	conn.Privmsg(channel, fmt.Sprintf("\001ACTION %s\001", action))
+func IRCAction(q *queue.Queue, channel, action string) {
+	q.Privmsg(channel, fmt.Sprintf("\001ACTION %s\001", action))
 }
 
-func IRCInvite(conn *irc.Connection, nick, channel string) {
-	conn.SendRawf("INVITE %s %s", nick, channel)
+func IRCInvite(q *queue.Queue, nick, channel string) {
+	q.SendRawf("INVITE %s %s", nick, channel)
 }
 
-func IRCOper(conn *irc.Connection, user, pass string) {
-	conn.SendRawf("OPER %s %s", user, pass)
+func IRCOper(q *queue.Queue, user, pass string) {
+	q.SendRawf("OPER %s %s", user, pass)
 }
 
-func IRCAway(conn *irc.Connection, message ...string) {
+func IRCAway(q *queue.Queue, message ...string) {
 	msg := strings.Join(message, " ")
 	if msg != "" {
 		msg = " :" + msg
 	}
-	conn.SendRawf("AWAY%s", msg)
+	q.SendRawf("AWAY%s", msg)
 }
 
-func IRCTopic(conn *irc.Connection, channel string, topic ...string) {
+func IRCTopic(q *queue.Queue, channel string, topic ...string) {
 	msg := strings.Join(topic, " ")
 	if msg != "" {
 		msg = " :" + msg
 	}
-	conn.SendRawf("TOPIC %s%s", channel, msg)
+	q.SendRawf("TOPIC %s%s", channel, msg)
 }
 
 func IRCRedispatch(conn *irc.Connection, code, raw, nick, host, source, user string, arguments ...string) {
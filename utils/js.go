@@ -16,3 +16,29 @@ func SliceToJavascriptArray(js *otto.Otto, slice interface{}) otto.Value {
 	}
 	return arr.Value()
 }
+
+// Returns the strings in a javascript array, false when it holds anything
+// else
+func JavascriptArrayToSlice(val otto.Value) ([]string, bool) {
+	list, err := val.Export()
+	if err != nil {
+		return nil, false
+	}
+	// Depending on the otto version, string arrays export as []string or
+	// []interface{}
+	switch list := list.(type) {
+	case []string:
+		return list, true
+	case []interface{}:
+		items := make([]string, 0, len(list))
+		for _, item := range list {
+			str, ok := item.(string)
+			if !ok {
+				return nil, false
+			}
+			items = append(items, str)
+		}
+		return items, true
+	}
+	return nil, false
+}